@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
 	"github.com/pkg/errors"
@@ -12,6 +16,7 @@ import (
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
 
+	"github.com/tritonmedia/bootstraper/internal/vfs"
 	"github.com/tritonmedia/bootstraper/pkg/codegen"
 	"github.com/tritonmedia/pkg/app"
 )
@@ -29,21 +34,19 @@ func main() {
 		Action: func(c *cli.Context) error {
 			dev := c.Bool("dev")
 
-			cwd, err := os.Getwd()
-			if err != nil {
-				return errors.Wrap(err, "failed to get the current working directory")
+			output := c.String("output")
+			if output != "text" && output != "json" {
+				return fmt.Errorf("invalid output '%s', expected 'text' or 'json'", output)
 			}
 
-			b, err := ioutil.ReadFile(filepath.Join(cwd, "service.yaml"))
+			cwd, err := os.Getwd()
 			if err != nil {
-				log.Info("A service.yaml can be generated with 'bootstraper generate'")
-				return errors.Wrap(err, "failed to read service.yaml")
+				return errors.Wrap(err, "failed to get the current working directory")
 			}
 
-			var m *codegen.ServiceManifest
-			err = yaml.Unmarshal(b, &m)
+			m, err := readManifest(log, cwd)
 			if err != nil {
-				return errors.Wrap(err, "failed to parse service.yaml")
+				return err
 			}
 
 			firstInit := false
@@ -65,7 +68,20 @@ func main() {
 			}
 
 			r := codegen.NewRenderer(log, branch, cwd, m)
-			err = r.Render(ctx, log)
+			r.SetStrict(c.Bool("strict"))
+			r.SetHookConsent(askHookConsent(c.Bool("allow-hooks")))
+			report, err := r.Render(ctx, log)
+
+			// the report is written even if rendering failed, so that it's
+			// clear what was written before it did
+			if output == "json" && report != nil {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if encErr := enc.Encode(report); encErr != nil {
+					return errors.Wrap(encErr, "failed to write report")
+				}
+			}
+
 			if err != nil {
 				return errors.Wrap(err, "failed to run bootstraper")
 			}
@@ -82,6 +98,65 @@ func main() {
 				Name:  "dev",
 				Usage: "Use local manifests instead of remote ones, useful for development",
 			},
+			&cli.BoolFlag{
+				Name:  "strict",
+				Usage: "Fail when a post-processor fails, e.g. on Go syntax errors, instead of warning",
+			},
+			&cli.BoolFlag{
+				Name:  "allow-hooks",
+				Usage: "Allow template repositories to run their hooks without asking",
+			},
+			&cli.StringFlag{
+				Name:  "output",
+				Value: "text",
+				Usage: "Format of the render report written to stdout, either 'text', for just logs, or 'json'",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "explain",
+				Usage:     "Explain which template repository provides a file",
+				ArgsUsage: "<path>",
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return fmt.Errorf("expected exactly one path")
+					}
+
+					cwd, err := os.Getwd()
+					if err != nil {
+						return errors.Wrap(err, "failed to get the current working directory")
+					}
+
+					m, err := readManifest(log, cwd)
+					if err != nil {
+						return err
+					}
+
+					return explain(codegen.NewFetcher(log, cwd, m), c.Args().First())
+				},
+			},
+			{
+				Name:      "test",
+				Usage:     "Test a template repository against the golden files of its test cases",
+				ArgsUsage: "[dir]",
+				Action: func(c *cli.Context) error {
+					dir := c.Args().First()
+					if dir == "" {
+						var err error
+						if dir, err = os.Getwd(); err != nil {
+							return errors.Wrap(err, "failed to get the current working directory")
+						}
+					}
+
+					return test(ctx, log, dir, c.Bool("update"))
+				},
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "update",
+						Usage: "Replace the golden files with the rendered files",
+					},
+				},
+			},
 		},
 	}
 
@@ -90,3 +165,118 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// readManifest reads the service.yaml in a directory
+func readManifest(log logrus.FieldLogger, dir string) (*codegen.ServiceManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "service.yaml"))
+	if err != nil {
+		log.Info("A service.yaml can be generated with 'bootstraper generate'")
+		return nil, errors.Wrap(err, "failed to read service.yaml")
+	}
+
+	var m *codegen.ServiceManifest
+	err = yaml.Unmarshal(b, &m)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse service.yaml")
+	}
+
+	return m, nil
+}
+
+// explain prints the template repository that provides a file, and the
+// template repositories that it shadows
+func explain(f *codegen.Fetcher, path string) error {
+	fs, _, err := f.CreateVFS()
+	if err != nil {
+		return err
+	}
+
+	mfs, ok := fs.(*vfs.MergedFS)
+	if !ok {
+		return fmt.Errorf("templates are not layered")
+	}
+
+	// a file is either a template, or copied as-is
+	for _, source := range []string{path + ".tpl", path} {
+		// Why: We're fine shadowing err.
+		//nolint:govet
+		p, err := mfs.Explain(source)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		fmt.Printf("%s: provided by %s (%s)\n", path, p.Layer, source)
+		for _, l := range p.Shadowed {
+			fmt.Printf("  shadows %s\n", l)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("'%s' is not provided by any template repository", path)
+}
+
+// askHookConsent returns a function that asks the user, on the terminal, if a
+// template repository may run its hooks, or always allows them if allow is set
+func askHookConsent(allow bool) codegen.HookConsent {
+	return func(repository string, hooks []codegen.Hook) (bool, error) {
+		if allow {
+			return true, nil
+		}
+
+		// we can't ask if there's nobody to answer
+		info, err := os.Stdin.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false, nil
+		}
+
+		fmt.Fprintf(os.Stderr, "Template repository '%s' wants to run the following commands in this service:\n", repository)
+		for _, h := range hooks {
+			fmt.Fprintf(os.Stderr, "  %s\n", strings.Join(h.Command, " "))
+			if len(h.Env) != 0 {
+				fmt.Fprintf(os.Stderr, "    with environment variables: %s\n", strings.Join(h.Env, ", "))
+			}
+		}
+		fmt.Fprint(os.Stderr, "Allow it to? [y/N] ")
+
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return false, errors.Wrap(err, "failed to read answer")
+		}
+
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes", nil
+	}
+}
+
+// test runs the test cases of a template repository, and prints their results
+func test(ctx context.Context, log logrus.FieldLogger, dir string, update bool) error {
+	results, err := codegen.RunTests(ctx, log, dir, update)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, r := range results {
+		if r.Passed() {
+			fmt.Printf("PASS %s\n", r.Name)
+			continue
+		}
+
+		failed++
+		fmt.Printf("FAIL %s\n", r.Name)
+		if r.Err != nil {
+			fmt.Printf("  %v\n", r.Err)
+		}
+		for _, d := range r.Diffs {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d test case(s) failed", failed, len(results))
+	}
+
+	return nil
+}
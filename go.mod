@@ -12,8 +12,10 @@ require (
 	github.com/stretchr/testify v1.6.1 // indirect
 	github.com/tritonmedia/pkg v0.0.0-20200629230110-aed2f5d2dc17
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/mod v0.3.0
 	golang.org/x/tools v0.0.0-20201116182000-1d699438d2cf
 	gopkg.in/src-d/go-billy.v4 v4.3.2
 	gopkg.in/yaml.v2 v2.3.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200615113413-eeeca48fe776
+	mvdan.cc/sh/v3 v3.1.2
 )
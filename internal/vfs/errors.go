@@ -0,0 +1,38 @@
+package vfs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// LayerError is an error that occurred in a specific layer of a MergedFS
+type LayerError struct {
+	// Layer is the layer the error occurred in
+	Layer Layer
+
+	Err error
+}
+
+func (e *LayerError) Error() string {
+	return fmt.Sprintf("layer '%s': %v", e.Layer, e.Err)
+}
+
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
+
+// MultiError is a list of errors that occurred across layers
+type MultiError []error
+
+func (m MultiError) Error() string {
+	if len(m) == 1 {
+		return m[0].Error()
+	}
+
+	errs := make([]string, len(m))
+	for i, err := range m {
+		errs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d errors occurred: %s", len(m), strings.Join(errs, "; "))
+}
@@ -0,0 +1,124 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// failingFS is a filesystem where reading a directory fails with err
+type failingFS struct {
+	billy.Filesystem
+
+	err error
+}
+
+func (f *failingFS) ReadDir(path string) ([]os.FileInfo, error) {
+	return nil, f.err
+}
+
+// newFailingLayer creates a layer, with files, where reading a directory
+// fails with err
+func newFailingLayer(t *testing.T, name string, files map[string]string, err error) Layer {
+	l := newLayer(t, name, 0, files, nil)
+	l.FS = &failingFS{Filesystem: l.FS, err: err}
+	return l
+}
+
+func TestMergedFSReadDirErrors(t *testing.T) {
+	errDenied := &os.PathError{Op: "readdir", Path: "dir", Err: syscall.EACCES}
+	errIO := errors.New("i/o error")
+
+	tests := []struct {
+		name   string
+		layers func(t *testing.T) []Layer
+
+		// failed are the names of the layers that should be in the error,
+		// none if reading the directory should succeed
+		failed []string
+	}{
+		{
+			name: "directory doesn't exist in a layer",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 0, map[string]string{"dir/a": ""}, nil),
+					newFailingLayer(t, "b", map[string]string{"other": ""}, os.ErrNotExist),
+				}
+			},
+		},
+		{
+			name: "directory is a file in a layer",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 0, map[string]string{"dir/a": ""}, nil),
+					newFailingLayer(t, "b", map[string]string{"other": ""},
+						&os.PathError{Op: "readdir", Path: "dir", Err: syscall.ENOTDIR}),
+				}
+			},
+		},
+		{
+			name: "layer fails",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 0, map[string]string{"dir/a": ""}, nil),
+					newFailingLayer(t, "b", map[string]string{"dir/b": ""}, errDenied),
+				}
+			},
+			failed: []string{"b"},
+		},
+		{
+			name: "every failing layer is reported",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newFailingLayer(t, "a", map[string]string{"dir/a": ""}, errIO),
+					newLayer(t, "b", 0, map[string]string{"dir/b": ""}, nil),
+					newFailingLayer(t, "c", map[string]string{"dir/c": ""}, errDenied),
+				}
+			},
+			failed: []string{"c", "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMergedFilesystem(tt.layers(t)...).ReadDir("dir")
+			if len(tt.failed) == 0 {
+				if err != nil {
+					t.Fatalf("ReadDir() = %v, want no error", err)
+				}
+				return
+			}
+
+			var errs MultiError
+			if !errors.As(err, &errs) {
+				t.Fatalf("ReadDir() = %v, want a MultiError", err)
+			}
+
+			failed := make([]string, 0)
+			for _, err := range errs {
+				var lerr *LayerError
+				if !errors.As(err, &lerr) {
+					t.Fatalf("error %v isn't a LayerError", err)
+				}
+
+				if want := "layer '" + lerr.Layer.Name + "'"; !strings.Contains(err.Error(), want) {
+					t.Errorf("Error() = %q, want it to name %s", err.Error(), want)
+				}
+
+				if errors.Is(lerr, os.ErrNotExist) {
+					t.Errorf("layer '%s' failed with a not exist error", lerr.Layer.Name)
+				}
+				failed = append(failed, lerr.Layer.Name)
+			}
+
+			if !reflect.DeepEqual(failed, tt.failed) {
+				t.Errorf("failed layers = %v, want %v", failed, tt.failed)
+			}
+		})
+	}
+}
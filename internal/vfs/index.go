@@ -0,0 +1,135 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// dirIndex is the merged contents of a directory
+type dirIndex struct {
+	// layers maps the name of every file in the directory to the position,
+	// in the search order, of the layer that it's read from
+	layers map[string]int
+
+	// infos are the files in the directory
+	infos []os.FileInfo
+}
+
+// readDirIndex returns the index of a directory, building it if it hasn't been
+// already. Layers are expected to not change, other than through the MergedFS,
+// since changes made through the MergedFS invalidate the index.
+func (m *MergedFS) readDirIndex(dir string) (*dirIndex, error) {
+	dir = m.Join(splitPath(dir)...)
+
+	m.indexMu.Lock()
+	idx, ok := m.index[dir]
+	m.indexMu.Unlock()
+	if ok {
+		return idx, nil
+	}
+
+	// this isn't done while holding the lock, since building the index of
+	// a directory requires the index of its parent
+	idx, err := m.buildDirIndex(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	m.indexMu.Lock()
+	m.index[dir] = idx
+	m.indexMu.Unlock()
+
+	return idx, nil
+}
+
+// buildDirIndex reads a directory across all available layers. Files in higher
+// layers take precedence, and whiteouts hide files in lower layers. Errors from
+// layers other than the directory not existing are returned as a MultiError of
+// LayerErrors.
+func (m *MergedFS) buildDirIndex(dir string) (*dirIndex, error) {
+	// not every filesystem returns an error when reading a directory that
+	// doesn't exist, so ensure it exists, and wasn't hidden, first
+	info, err := m.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	idx := &dirIndex{
+		layers: make(map[string]int),
+		infos:  make([]os.FileInfo, 0),
+	}
+	whiteouts := make(map[string]bool)
+	errs := make(MultiError, 0)
+
+	for i, l := range m.searchOrder() {
+		// a layer not having this directory isn't an error, since it's
+		// likely only in some of them
+		filelist, err := l.FS.ReadDir(dir)
+		if err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTDIR) {
+			errs = append(errs, &LayerError{Layer: l, Err: err})
+			continue
+		}
+
+		for _, f := range filelist {
+			name := f.Name()
+			if IsWhiteout(name) {
+				continue
+			}
+
+			if _, ok := idx.layers[name]; ok || whiteouts[name] {
+				continue
+			}
+
+			idx.layers[name] = i
+			idx.infos = append(idx.infos, f)
+		}
+
+		// whiteouts only apply to the layers below this one
+		for _, f := range filelist {
+			if IsWhiteout(f.Name()) {
+				whiteouts[strings.TrimPrefix(f.Name(), WhiteoutPrefix)] = true
+			}
+		}
+
+		// stop if this layer hides this directory, or its contents, from
+		// the layers below it
+		if HidesLower(l.FS, dir) || exists(l.FS, l.FS.Join(dir, WhiteoutOpaque)) {
+			break
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	sort.Slice(idx.infos, func(i, j int) bool {
+		return idx.infos[i].Name() < idx.infos[j].Name()
+	})
+
+	return idx, nil
+}
+
+// invalidate removes a path, its parents, and its children from the
+// index, so that changes to them are seen
+func (m *MergedFS) invalidate(path string) {
+	path = m.Join(splitPath(path)...)
+
+	m.indexMu.Lock()
+	defer m.indexMu.Unlock()
+
+	for dir := range m.index {
+		isParent := dir == "" || strings.HasPrefix(path, dir+"/")
+		isChild := strings.HasPrefix(dir, path+"/")
+		if dir == path || isParent || isChild {
+			delete(m.index, dir)
+		}
+	}
+}
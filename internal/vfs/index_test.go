@@ -0,0 +1,168 @@
+package vfs
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// listDir returns the names of the files in a directory
+func listDir(t testing.TB, m *MergedFS, dir string) []string {
+	infos, err := m.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", dir, err)
+	}
+
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+
+	return names
+}
+
+func TestMergedFSIndexInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(m *MergedFS) error
+
+		// want are the names in a, and in a/b, after the change
+		want    []string
+		wantSub []string
+	}{
+		{
+			name: "create",
+			change: func(m *MergedFS) error {
+				return util.WriteFile(m, "a/b/z", nil, 0644)
+			},
+			want:    []string{"b", "x"},
+			wantSub: []string{"y", "z"},
+		},
+		{
+			name: "remove",
+			change: func(m *MergedFS) error {
+				return m.Remove("a/b/y")
+			},
+			want:    []string{"b", "x"},
+			wantSub: []string{},
+		},
+		{
+			name: "rename",
+			change: func(m *MergedFS) error {
+				return m.Rename("a/b/y", "a/y")
+			},
+			want:    []string{"b", "x", "y"},
+			wantSub: []string{},
+		},
+		{
+			name: "rename directory",
+			change: func(m *MergedFS) error {
+				return m.Rename("a/b", "a/c")
+			},
+			want: []string{"c", "x"},
+		},
+		{
+			name: "mkdir",
+			change: func(m *MergedFS) error {
+				return m.MkdirAll("a/b/c/d", os.ModePerm)
+			},
+			want:    []string{"b", "x"},
+			wantSub: []string{"c", "y"},
+		},
+		{
+			name: "symlink",
+			change: func(m *MergedFS) error {
+				return m.Symlink("y", "a/b/l")
+			},
+			want:    []string{"b", "x"},
+			wantSub: []string{"l", "y"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewWritableMergedFilesystem(memfs.New(),
+				newLayer(t, "lower", 0, map[string]string{"a/x": "", "a/b/y": ""}, nil))
+
+			// build the index of every directory first
+			listDir(t, m, "")
+			listDir(t, m, "a")
+			listDir(t, m, "a/b")
+
+			if err := tt.change(m); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := listDir(t, m, "a"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadDir(a) = %v, want %v", got, tt.want)
+			}
+
+			if tt.wantSub == nil {
+				if _, err := m.Stat("a/b"); !os.IsNotExist(err) {
+					t.Errorf("Stat(a/b) = %v, want not exist", err)
+				}
+				return
+			}
+
+			if got := listDir(t, m, "a/b"); !reflect.DeepEqual(got, tt.wantSub) {
+				t.Errorf("ReadDir(a/b) = %v, want %v", got, tt.wantSub)
+			}
+		})
+	}
+}
+
+// newBenchmarkFS creates a MergedFS of layers that each have files spread
+// across directories of 100 files
+func newBenchmarkFS(b *testing.B, files, layers int) *MergedFS {
+	ls := make([]Layer, layers)
+	for i := range ls {
+		paths := make(map[string]string)
+		for j := 0; j < files; j++ {
+			paths[fmt.Sprintf("dir%d/layer%d-file%d", j/100, i, j)] = ""
+		}
+		ls[i] = newLayer(b, fmt.Sprintf("layer%d", i), 0, paths, nil)
+	}
+
+	return NewMergedFilesystem(ls...)
+}
+
+// walkAll walks every file in a filesystem
+func walkAll(b *testing.B, m *MergedFS) {
+	err := Walk(m, "", func(path string, info os.FileInfo, err error) error {
+		return err
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkWalk(b *testing.B) {
+	for _, files := range []int{100, 1000} {
+		for _, layers := range []int{1, 5, 20} {
+			b.Run(fmt.Sprintf("files=%d/layers=%d", files, layers), func(b *testing.B) {
+				m := newBenchmarkFS(b, files, layers)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// a new filesystem for every walk, so that the index is
+					// built each time
+					walkAll(b, NewMergedFilesystem(m.Layers()...))
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkWalkIndexed(b *testing.B) {
+	m := newBenchmarkFS(b, 1000, 20)
+	walkAll(b, m)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		walkAll(b, m)
+	}
+}
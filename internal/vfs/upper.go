@@ -0,0 +1,193 @@
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// UpperLayerName is the name of the writable layer of a MergedFS
+const UpperLayerName = "upper"
+
+// ErrReadOnly is returned when modifying a MergedFS without an upper layer
+var ErrReadOnly = fmt.Errorf("unsupported on merged filesystem without an upper layer")
+
+// NewWritableMergedFilesystem creates a MergedFS with a writable upper layer
+// above every other layer. Modifications are made to the upper layer, copying
+// files up from the lower layers first, and removals hide files in the lower
+// layers with whiteouts.
+func NewWritableMergedFilesystem(upper billy.Filesystem, layers ...Layer) *MergedFS {
+	m := NewMergedFilesystem(layers...)
+	m.upper = upper
+	return m
+}
+
+// writable returns an error if a path can't be modified
+func (m *MergedFS) writable(path string) error {
+	if m.upper == nil {
+		return ErrReadOnly
+	}
+
+	if isHidden(path) {
+		return fmt.Errorf("'%s' is reserved for whiteouts", path)
+	}
+
+	return nil
+}
+
+// copyUp copies a file, or directory and its contents, into the upper
+// layer, along with its parent directories, if it isn't already there
+func (m *MergedFS) copyUp(path string) error {
+	if len(splitPath(path)) == 0 {
+		return nil
+	}
+
+	info, err := m.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	// directories may exist in the upper layer without all of their contents
+	if !info.IsDir() && exists(m.upper, path) {
+		return nil
+	}
+
+	if err := m.copyUpDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	switch {
+	case info.IsDir():
+		if err := m.upper.MkdirAll(path, info.Mode().Perm()); err != nil {
+			return err
+		}
+
+		files, err := m.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if err := m.copyUp(m.Join(path, f.Name())); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := m.Readlink(path)
+		if err != nil {
+			return err
+		}
+
+		return m.upper.Symlink(target, path)
+	default:
+		return m.copyFileUp(path, info.Mode().Perm())
+	}
+}
+
+// copyUpDir creates a directory, and its parents, in the upper layer with
+// the same permissions that they have in the lower layers, without their contents
+func (m *MergedFS) copyUpDir(dir string) error {
+	if len(splitPath(dir)) == 0 || exists(m.upper, dir) {
+		return nil
+	}
+
+	info, err := m.Lstat(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := m.copyUpDir(filepath.Dir(dir)); err != nil {
+		return err
+	}
+
+	return m.upper.MkdirAll(dir, info.Mode().Perm())
+}
+
+// copyFileUp copies the contents of a file into the upper layer
+func (m *MergedFS) copyFileUp(path string, perm os.FileMode) error {
+	src, err := m.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := m.upper.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	return dst.Close()
+}
+
+// whiteout hides a path in the lower layers, if it's in one
+func (m *MergedFS) whiteout(path string) error {
+	inLower := false
+	for _, l := range m.layers {
+		if exists(l.FS, path) {
+			inLower = true
+			break
+		}
+	}
+
+	if !inLower {
+		return nil
+	}
+
+	dir, name := filepath.Split(path)
+	if err := m.upper.MkdirAll(m.Join(dir), os.ModePerm); err != nil {
+		return err
+	}
+
+	f, err := m.upper.Create(m.Join(dir, WhiteoutPrefix+name))
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// removeWhiteouts removes the whiteouts in a directory of the upper layer
+func (m *MergedFS) removeWhiteouts(dir string) error {
+	files, err := m.upper.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if !IsWhiteout(f.Name()) {
+			continue
+		}
+
+		if err := m.upper.Remove(m.Join(dir, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// change copies up a file and returns the upper layer, if it supports
+// changing file metadata
+func (m *MergedFS) change(path string) (billy.Change, error) {
+	if err := m.writable(path); err != nil {
+		return nil, err
+	}
+
+	ch, ok := m.upper.(billy.Change)
+	if !ok {
+		return nil, fmt.Errorf("upper layer does not support changing files")
+	}
+
+	defer m.invalidate(path)
+	return ch, m.copyUp(path)
+}
@@ -0,0 +1,205 @@
+package vfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// newWritable creates a writable MergedFS, and its upper layer, over a
+// single lower layer
+func newWritable(t *testing.T, files map[string]string) (*MergedFS, billy.Filesystem) {
+	upper := memfs.New()
+	return NewWritableMergedFilesystem(upper, newLayer(t, "lower", 0, files, nil)), upper
+}
+
+func TestMergedFSReadOnly(t *testing.T) {
+	m := NewMergedFilesystem(newLayer(t, "lower", 0, map[string]string{"a": "a"}, nil))
+
+	if _, err := m.Create("b"); err != ErrReadOnly {
+		t.Errorf("Create() = %v, want %v", err, ErrReadOnly)
+	}
+
+	if err := m.Remove("a"); err != ErrReadOnly {
+		t.Errorf("Remove() = %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestMergedFSCreate(t *testing.T) {
+	m, upper := newWritable(t, map[string]string{"dir/a": "lower"})
+
+	if err := util.WriteFile(m, "dir/b", []byte("upper"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !exists(upper, "dir/b") {
+		t.Error("created file isn't in the upper layer")
+	}
+
+	want := map[string]int64{"a": 5, "b": 5}
+	if got := readDirSizes(t, m, "dir"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir() = %v, want %v", got, want)
+	}
+
+	if _, err := m.Create(".wh.a"); err == nil {
+		t.Error("Create() of a whiteout succeeded, want an error")
+	}
+}
+
+func TestMergedFSCopyUp(t *testing.T) {
+	m, upper := newWritable(t, map[string]string{"dir/a": "lower"})
+
+	f, err := m.OpenFile("dir/a", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Write([]byte("+upper")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readString(t, m, "dir/a"); got != "lower+upper" {
+		t.Errorf("Open() = %q, want %q", got, "lower+upper")
+	}
+
+	if got := readString(t, upper, "dir/a"); got != "lower+upper" {
+		t.Errorf("upper layer contents = %q, want %q", got, "lower+upper")
+	}
+
+	if _, err := upper.Stat("dir"); err != nil {
+		t.Errorf("parent directory wasn't copied up: %v", err)
+	}
+}
+
+func TestMergedFSRename(t *testing.T) {
+	m, _ := newWritable(t, map[string]string{"dir/a": "lower", "dir/b": "lower"})
+
+	if err := m.Rename("dir", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Stat("dir"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of the old path = %v, want not exist", err)
+	}
+
+	want := map[string]int64{"a": 5, "b": 5}
+	if got := readDirSizes(t, m, "renamed"); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir() = %v, want %v", got, want)
+	}
+
+	if err := m.Rename("renamed/a", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readString(t, m, "c"); got != "lower" {
+		t.Errorf("Open() = %q, want %q", got, "lower")
+	}
+}
+
+func TestMergedFSRemove(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove []string
+
+		// want are the names in the root after removing, and err is
+		// whether the last removal should fail
+		want []string
+		err  bool
+	}{
+		{
+			name:   "file in a lower layer",
+			remove: []string{"a/x"},
+			want:   []string{"a", "b"},
+		},
+		{
+			name:   "directory after removing its files",
+			remove: []string{"a/x", "a/y", "a"},
+			want:   []string{"b"},
+		},
+		{
+			name:   "directory that isn't empty",
+			remove: []string{"a/x", "a"},
+			err:    true,
+		},
+		{
+			name:   "file that doesn't exist",
+			remove: []string{"c"},
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, upper := newWritable(t, map[string]string{"a/x": "", "a/y": "", "b/z": ""})
+
+			var err error
+			for _, path := range tt.remove {
+				if err = m.Remove(path); err != nil {
+					break
+				}
+			}
+
+			if (err != nil) != tt.err {
+				t.Fatalf("Remove() = %v, want error %v", err, tt.err)
+			}
+
+			if tt.err {
+				return
+			}
+
+			infos, err := m.ReadDir("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]string, len(infos))
+			for i, info := range infos {
+				got[i] = info.Name()
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadDir() = %v, want %v", got, tt.want)
+			}
+
+			for _, path := range tt.remove {
+				if _, err := m.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("Stat(%q) = %v, want not exist", path, err)
+				}
+			}
+
+			// the last removal is hidden by a whiteout, and isn't left in
+			// the upper layer
+			last := tt.remove[len(tt.remove)-1]
+			if !HidesLower(upper, last) {
+				t.Errorf("%q isn't hidden by a whiteout", last)
+			}
+
+			if exists(upper, last) {
+				t.Errorf("%q is still in the upper layer", last)
+			}
+		})
+	}
+}
+
+func TestMergedFSRemoveRecreate(t *testing.T) {
+	m, _ := newWritable(t, map[string]string{"a/x": "lower"})
+
+	if err := m.Remove("a/x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := util.WriteFile(m, "a/x", []byte("upper"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readString(t, m, "a/x"); got != "upper" {
+		t.Errorf("Open() = %q, want %q", got, "upper")
+	}
+}
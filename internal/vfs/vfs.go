@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-billy/v5"
@@ -13,35 +15,188 @@ import (
 var _ billy.Filesystem = &MergedFS{}
 
 type MergedFS struct {
-	filesystems []billy.Filesystem
+	layers []Layer
+
+	// upper is a writable layer above every other layer, if set
+	upper billy.Filesystem
+
+	// index caches the merged contents of directories, see readDirIndex
+	index   map[string]*dirIndex
+	indexMu sync.Mutex
+
+	// root is the path, in every layer, that this filesystem is rooted at
+	root string
+
+	// parent is the filesystem that this one was chrooted from, and prefix is
+	// the path in parent that it's chrooted to. Every operation is delegated to
+	// parent, so that both share the same index and upper layer.
+	parent *MergedFS
+	prefix string
+}
+
+// Layer is a filesystem that is part of a MergedFS
+type Layer struct {
+	// Name identifies where this layer came from, e.g. a Git URL
+	Name string
+
+	// Version is the version of this layer, if it has one
+	Version string
+
+	// Priority orders this layer relative to the others, higher priority
+	// layers are searched first
+	Priority int
+
+	FS billy.Filesystem
 }
 
-// NewMergedFilesystem creates a "layered" file-system where
-// higher indexed file systems are searched first, and then down, returning
-// an error if not found
-func NewMergedFilesystem(filesystems ...billy.Filesystem) *MergedFS {
+// String returns the name and, if set, version of this layer
+func (l Layer) String() string {
+	if l.Version == "" {
+		return l.Name
+	}
+
+	return l.Name + "@" + l.Version
+}
+
+// NewMergedFilesystem creates a "layered" file-system where higher
+// priority, and then higher indexed, file systems are searched first, and
+// then down, returning an error if not found. The same order is used by every
+// method, so a file is always read from the first layer, in that order, that has it.
+func NewMergedFilesystem(layers ...Layer) *MergedFS {
+	sorted := make([]Layer, len(layers))
+	copy(sorted, layers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority < sorted[j].Priority
+	})
+
 	return &MergedFS{
-		filesystems: filesystems,
+		layers: sorted,
+		root:   string(filepath.Separator),
+		index:  make(map[string]*dirIndex),
 	}
 }
 
 // findFile finds a file across all filesystems, and returns a os.ErrNotExist
-// if it's not found, and returns the filesystem it belongs to if it's found
+// if it's not found, or was hidden by a whiteout, and returns the filesystem
+// it belongs to if it's found
 func (m *MergedFS) findFile(path string) (billy.Filesystem, error) {
-	for _, fs := range m.filesystems {
-		if _, err := fs.Stat(path); err == nil {
-			return fs, nil
+	i, err := m.findLayer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.layerAt(i).FS, nil
+}
+
+// findLayer is findFile, but returns the position of the layer the file
+// belongs to in the search order
+func (m *MergedFS) findLayer(path string) (int, error) {
+	if isHidden(path) {
+		return -1, os.ErrNotExist
+	}
+
+	segments := splitPath(path)
+	if len(segments) == 0 {
+		for i, l := range m.searchOrder() {
+			if _, err := l.FS.Stat(path); err == nil {
+				return i, nil
+			}
+		}
+
+		return -1, os.ErrNotExist
+	}
+
+	idx, err := m.readDirIndex(m.Join(segments[:len(segments)-1]...))
+	if err != nil {
+		return -1, err
+	}
+
+	i, ok := idx.layers[segments[len(segments)-1]]
+	if !ok {
+		return -1, os.ErrNotExist
+	}
+
+	return i, nil
+}
+
+// searchOrder returns the layers in the order they should be searched,
+// the upper layer and then highest priority first. The first layer that
+// contains a path is the one that it's read from.
+func (m *MergedFS) searchOrder() []Layer {
+	order := make([]Layer, 0, len(m.layers)+1)
+	if m.upper != nil {
+		order = append(order, Layer{Name: UpperLayerName, FS: m.upper})
+	}
+
+	for i := len(m.layers) - 1; i >= 0; i-- {
+		order = append(order, m.layers[i])
+	}
+
+	return order
+}
+
+// layerAt returns the layer at a position in the search order, without building
+// the search order, since this is called for every file that's looked up
+func (m *MergedFS) layerAt(i int) Layer {
+	if m.upper != nil {
+		if i == 0 {
+			return Layer{Name: UpperLayerName, FS: m.upper}
+		}
+		i--
+	}
+
+	return m.layers[len(m.layers)-1-i]
+}
+
+// Layers returns the underlying layers, lowest priority first, excluding
+// the upper layer
+func (m *MergedFS) Layers() []Layer {
+	return m.layers
+}
+
+// Provenance describes the layers that provide a path
+type Provenance struct {
+	// Layer is the layer that the path is read from
+	Layer Layer
+
+	// Shadowed are the lower layers that also contain the path, but
+	// are hidden by Layer, in the order they're searched
+	Shadowed []Layer
+}
+
+// Explain returns which layer a path is read from, and which layers
+// it shadows, or os.ErrNotExist if it isn't in any layer
+func (m *MergedFS) Explain(path string) (*Provenance, error) {
+	if m.parent != nil {
+		return m.parent.Explain(m.abs(path))
+	}
+
+	i, err := m.findLayer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	order := m.searchOrder()
+	p := &Provenance{Layer: order[i], Shadowed: make([]Layer, 0)}
+	for _, l := range order[i+1:] {
+		if _, err := l.FS.Stat(path); err == nil {
+			p.Shadowed = append(p.Shadowed, l)
 		}
 	}
 
-	return nil, os.ErrNotExist
+	return p, nil
 }
 
+// Create creates a file in the upper layer
 func (m *MergedFS) Create(path string) (billy.File, error) {
-	return nil, fmt.Errorf("unsupported on merged filesystem")
+	return m.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 }
 
 func (m *MergedFS) Open(path string) (billy.File, error) {
+	if m.parent != nil {
+		return m.chrootFile(m.parent.Open(m.abs(path)))
+	}
+
 	fs, err := m.findFile(path)
 	if err != nil {
 		return nil, err
@@ -50,11 +205,48 @@ func (m *MergedFS) Open(path string) (billy.File, error) {
 	return fs.Open(path)
 }
 
+// OpenFile opens a file for reading from the layer it's in, or for writing from
+// the upper layer, copying it up first if it's in a lower layer
 func (m *MergedFS) OpenFile(path string, flag int, perm os.FileMode) (billy.File, error) {
-	return nil, fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.chrootFile(m.parent.OpenFile(m.abs(path), flag, perm))
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) == 0 {
+		fs, err := m.findFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return fs.OpenFile(path, flag, perm)
+	}
+
+	if err := m.writable(path); err != nil {
+		return nil, err
+	}
+
+	// there's no point in copying up a file that's being truncated, but its
+	// directory still needs to exist in the upper layer
+	copyUp := m.copyUp
+	if flag&os.O_TRUNC != 0 {
+		copyUp = func(path string) error {
+			return m.copyUpDir(filepath.Dir(path))
+		}
+	}
+
+	if err := copyUp(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	defer m.invalidate(path)
+	return m.upper.OpenFile(path, flag, perm)
 }
 
 func (m *MergedFS) Stat(path string) (os.FileInfo, error) {
+	if m.parent != nil {
+		return m.parent.Stat(m.abs(path))
+	}
+
 	fs, err := m.findFile(path)
 	if err != nil {
 		return nil, err
@@ -63,61 +255,150 @@ func (m *MergedFS) Stat(path string) (os.FileInfo, error) {
 	return fs.Stat(path)
 }
 
+// Rename copies up a file, or directory, and renames it in the upper layer,
+// hiding the original from the lower layers
 func (m *MergedFS) Rename(oldPath, newPath string) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Rename(m.abs(oldPath), m.abs(newPath))
+	}
+
+	if err := m.writable(oldPath); err != nil {
+		return err
+	}
+
+	if err := m.writable(newPath); err != nil {
+		return err
+	}
+	defer m.invalidate(oldPath)
+	defer m.invalidate(newPath)
+
+	if err := m.copyUp(oldPath); err != nil {
+		return err
+	}
+
+	if err := m.copyUpDir(filepath.Dir(newPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := m.upper.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	return m.whiteout(oldPath)
 }
 
+// Remove removes a file, or empty directory, from the upper layer and
+// hides it in the lower layers
 func (m *MergedFS) Remove(path string) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Remove(m.abs(path))
+	}
+
+	if err := m.writable(path); err != nil {
+		return err
+	}
+
+	info, err := m.Lstat(path)
+	if err != nil {
+		return err
+	}
+	defer m.invalidate(path)
+
+	if info.IsDir() {
+		files, err := m.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		if len(files) != 0 {
+			return fmt.Errorf("directory '%s' is not empty", path)
+		}
+	}
+
+	if exists(m.upper, path) {
+		// a directory that's empty through the MergedFS can still contain
+		// whiteouts in the upper layer, which the directory's whiteout replaces
+		if info.IsDir() {
+			if err := m.removeWhiteouts(path); err != nil {
+				return err
+			}
+		}
+
+		if err := m.upper.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	return m.whiteout(path)
 }
 
 func (m *MergedFS) Join(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
+// TempFile creates a temporary file in the upper layer
 func (m *MergedFS) TempFile(dir, prefix string) (billy.File, error) {
-	return nil, fmt.Errorf("unsupported on merged filesystem")
-}
+	if m.parent != nil {
+		return m.chrootFile(m.parent.TempFile(m.abs(dir), prefix))
+	}
 
-// ReadDir will read a directory across all available filesystems, and deduplicate
-func (m *MergedFS) ReadDir(dir string) ([]os.FileInfo, error) {
-	files := make(map[string]os.FileInfo)
+	if err := m.writable(dir); err != nil {
+		return nil, err
+	}
 
-	foundDir := true
-	for _, fs := range m.filesystems {
-		filelist, err := fs.ReadDir(dir)
-		if err != nil {
-			// TODO(jaredallard): better error handling here
-			continue
-		}
+	if err := m.copyUpDir(dir); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 
-		// if we had no error at one point, we set foundDir
-		// to make sure we return the correct error type across
-		// all of the filesystems
-		foundDir = true
-		for _, f := range filelist {
-			files[f.Name()] = f
-		}
+	defer m.invalidate(dir)
+	return m.upper.TempFile(dir, prefix)
+}
+
+// ReadDir will read a directory across all available filesystems, and deduplicate,
+// returning the files sorted by name. Whiteouts are never returned, and hide the
+// files they refer to in lower layers.
+func (m *MergedFS) ReadDir(dir string) ([]os.FileInfo, error) {
+	if m.parent != nil {
+		return m.parent.ReadDir(m.abs(dir))
 	}
 
-	// if we didn't find it at, assume ErrNotExist was the reason
-	if !foundDir {
-		return nil, os.ErrNotExist
+	idx, err := m.readDirIndex(dir)
+	if err != nil {
+		return nil, err
 	}
 
-	// convert our de-duplication hash map back into a list
-	list := make([]os.FileInfo, len(files))
-	i := 0
-	for _, f := range files {
-		list[i] = f
-		i++
+	list := make([]os.FileInfo, len(idx.infos))
+	copy(list, idx.infos)
+
+	// files in the upper layer can change after the index was built, so
+	// those need to be read again
+	if m.upper != nil {
+		for i, info := range list {
+			if idx.layers[info.Name()] != 0 {
+				continue
+			}
+
+			if list[i], err = m.upper.Lstat(m.Join(dir, info.Name())); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return list, nil
 }
 
+// MkdirAll creates a directory, and its parents, in the upper layer
 func (m *MergedFS) MkdirAll(dir string, perm os.FileMode) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.MkdirAll(m.abs(dir), perm)
+	}
+
+	if err := m.writable(dir); err != nil {
+		return err
+	}
+
+	defer m.invalidate(dir)
+	return m.upper.MkdirAll(dir, perm)
 }
 
 ///
@@ -125,6 +406,10 @@ func (m *MergedFS) MkdirAll(dir string, perm os.FileMode) error {
 ///
 
 func (m *MergedFS) Lstat(path string) (os.FileInfo, error) {
+	if m.parent != nil {
+		return m.parent.Lstat(m.abs(path))
+	}
+
 	fs, err := m.findFile(path)
 	if err != nil {
 		return nil, err
@@ -133,11 +418,29 @@ func (m *MergedFS) Lstat(path string) (os.FileInfo, error) {
 	return fs.Lstat(path)
 }
 
+// Symlink creates a symlink in the upper layer
 func (m *MergedFS) Symlink(target, link string) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Symlink(target, m.abs(link))
+	}
+
+	if err := m.writable(link); err != nil {
+		return err
+	}
+
+	if err := m.copyUpDir(filepath.Dir(link)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	defer m.invalidate(link)
+	return m.upper.Symlink(target, link)
 }
 
 func (m *MergedFS) Readlink(path string) (string, error) {
+	if m.parent != nil {
+		return m.parent.Readlink(m.abs(path))
+	}
+
 	fs, err := m.findFile(path)
 	if err != nil {
 		return "", err
@@ -151,35 +454,144 @@ func (m *MergedFS) Readlink(path string) (string, error) {
 ///
 
 func (m *MergedFS) Chmod(name string, mode os.FileMode) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Chmod(m.abs(name), mode)
+	}
+
+	ch, err := m.change(name)
+	if err != nil {
+		return err
+	}
+
+	return ch.Chmod(name, mode)
 }
 
 func (m *MergedFS) Lchown(name string, uid, gid int) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Lchown(m.abs(name), uid, gid)
+	}
+
+	ch, err := m.change(name)
+	if err != nil {
+		return err
+	}
+
+	return ch.Lchown(name, uid, gid)
 }
 
 func (m *MergedFS) Chown(name string, uid, gid int) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Chown(m.abs(name), uid, gid)
+	}
+
+	ch, err := m.change(name)
+	if err != nil {
+		return err
+	}
+
+	return ch.Chown(name, uid, gid)
 }
 
 func (m *MergedFS) Chtimes(name string, atime, mtime time.Time) error {
-	return fmt.Errorf("unsupported on merged filesystem")
+	if m.parent != nil {
+		return m.parent.Chtimes(m.abs(name), atime, mtime)
+	}
+
+	ch, err := m.change(name)
+	if err != nil {
+		return err
+	}
+
+	return ch.Chtimes(name, atime, mtime)
 }
 
 ///
 // Chroot
 ///
 
+// Chroot returns a new MergedFS of every layer that has the given directory,
+// chrooted to that directory. Changes made through either filesystem are seen
+// by the other.
 func (m *MergedFS) Chroot(path string) (billy.Filesystem, error) {
-	fs, err := m.findFile(path)
+	if m.parent != nil {
+		return m.parent.Chroot(m.abs(path))
+	}
+
+	info, err := m.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", path)
+	}
+
+	// build the layers lowest first, since we're iterating highest first
+	layers := make([]Layer, 0)
+	for i, l := range m.searchOrder() {
+		isUpper := m.upper != nil && i == 0
+
+		// Why: We're fine shadowing info and err.
+		//nolint:govet
+		if info, err := l.FS.Stat(path); err == nil && info.IsDir() && !isUpper {
+			fs, err := l.FS.Chroot(path)
+			if err != nil {
+				return nil, err
+			}
+
+			layers = append([]Layer{{
+				Name:     l.Name,
+				Version:  l.Version,
+				Priority: l.Priority,
+				FS:       fs,
+			}}, layers...)
+		}
+
+		if HidesLower(l.FS, path) || exists(l.FS, l.FS.Join(path, WhiteoutOpaque)) {
+			break
+		}
+	}
+
+	return &MergedFS{
+		layers: layers,
+		root:   m.Join(m.root, path),
+		parent: m,
+		prefix: m.Join(splitPath(path)...),
+	}, nil
+}
+
+// abs returns the path, in the parent of a chrooted filesystem, of a path
+func (m *MergedFS) abs(path string) string {
+	return m.Join(m.prefix, path)
+}
+
+// chrootFile names a file opened through the parent of a chrooted filesystem
+// relative to the chrooted filesystem
+func (m *MergedFS) chrootFile(f billy.File, err error) (billy.File, error) {
 	if err != nil {
 		return nil, err
 	}
 
-	return fs.Chroot(path)
+	name, err := filepath.Rel(m.prefix, f.Name())
+	if err != nil {
+		return f, nil
+	}
+
+	return &chrootFile{File: f, name: name}, nil
+}
+
+// chrootFile is a file opened through a chrooted filesystem
+type chrootFile struct {
+	billy.File
+
+	name string
+}
+
+func (f *chrootFile) Name() string {
+	return f.name
 }
 
+// Root returns the path, in every layer, that this filesystem is rooted at
 func (m *MergedFS) Root() string {
-	// TODO(jaredallard): figure this one out
-	return ""
+	return m.root
 }
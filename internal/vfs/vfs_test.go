@@ -0,0 +1,265 @@
+package vfs
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+)
+
+// newLayer creates an in-memory layer with files, by path, and symlinks,
+// by path to their target
+func newLayer(t testing.TB, name string, priority int, files, symlinks map[string]string) Layer {
+	fs := memfs.New()
+	for path, data := range files {
+		if err := util.WriteFile(fs, path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for link, target := range symlinks {
+		if err := fs.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return Layer{Name: name, Priority: priority, FS: fs}
+}
+
+// readString reads a file from a filesystem
+func readString(t testing.TB, fs billy.Filesystem, path string) string {
+	f, err := fs.Open(path)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", path, err)
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
+
+// readDirSizes returns the sizes of the files in a directory, by name
+func readDirSizes(t testing.TB, fs billy.Filesystem, dir string) map[string]int64 {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir(%q): %v", dir, err)
+	}
+
+	sizes := make(map[string]int64)
+	for _, info := range infos {
+		sizes[info.Name()] = info.Size()
+	}
+
+	return sizes
+}
+
+func TestMergedFSPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers func(t *testing.T) []Layer
+		upper  map[string]string
+
+		// want is the contents of f, and link is the target of l
+		want string
+		link string
+	}{
+		{
+			name: "later layer wins a priority tie",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 0, map[string]string{"dir/f": "a"}, map[string]string{"dir/l": "a"}),
+					newLayer(t, "bb", 0, map[string]string{"dir/f": "bb"}, map[string]string{"dir/l": "bb"}),
+				}
+			},
+			want: "bb",
+			link: "bb",
+		},
+		{
+			name: "higher priority wins over a later layer",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 1, map[string]string{"dir/f": "a"}, map[string]string{"dir/l": "a"}),
+					newLayer(t, "bb", 0, map[string]string{"dir/f": "bb"}, map[string]string{"dir/l": "bb"}),
+				}
+			},
+			want: "a",
+			link: "a",
+		},
+		{
+			name: "lower layer is used when higher layers don't have the file",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 0, map[string]string{"dir/f": "a"}, map[string]string{"dir/l": "a"}),
+					newLayer(t, "bb", 1, map[string]string{"dir/g": "bb"}, nil),
+				}
+			},
+			want: "a",
+			link: "a",
+		},
+		{
+			name: "upper layer wins over every layer",
+			layers: func(t *testing.T) []Layer {
+				return []Layer{
+					newLayer(t, "a", 0, map[string]string{"dir/f": "a"}, map[string]string{"dir/l": "a"}),
+					newLayer(t, "bb", 10, map[string]string{"dir/f": "bb"}, map[string]string{"dir/l": "bb"}),
+				}
+			},
+			upper: map[string]string{"dir/f": "upper"},
+			want:  "upper",
+			link:  "bb",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers := tt.layers(t)
+
+			m := NewMergedFilesystem(layers...)
+			if tt.upper != nil {
+				m = NewWritableMergedFilesystem(newLayer(t, UpperLayerName, 0, tt.upper, nil).FS, layers...)
+			}
+
+			if got := readString(t, m, "dir/f"); got != tt.want {
+				t.Errorf("Open() = %q, want %q", got, tt.want)
+			}
+
+			info, err := m.Stat("dir/f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(len(tt.want)) {
+				t.Errorf("Stat().Size() = %d, want %d", info.Size(), len(tt.want))
+			}
+
+			info, err = m.Lstat("dir/l")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode()&os.ModeSymlink == 0 {
+				t.Errorf("Lstat() of a symlink isn't a symlink: %v", info.Mode())
+			}
+
+			target, err := m.Readlink("dir/l")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if target != tt.link {
+				t.Errorf("Readlink() = %q, want %q", target, tt.link)
+			}
+
+			sizes := readDirSizes(t, m, "dir")
+			if sizes["f"] != int64(len(tt.want)) {
+				t.Errorf("ReadDir() size of f = %d, want %d", sizes["f"], len(tt.want))
+			}
+
+			p, err := m.Explain("dir/f")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.Layer.Name != tt.want {
+				t.Errorf("Explain().Layer = %q, want %q", p.Layer.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergedFSReadDirMergesLayers(t *testing.T) {
+	m := NewMergedFilesystem(
+		newLayer(t, "a", 0, map[string]string{"b": "a", "c": "a", ".wh.ignored": ""}, nil),
+		newLayer(t, "b", 0, map[string]string{"a": "b", "c": "bb", ".wh.b": ""}, nil),
+	)
+
+	got := readDirSizes(t, m, "")
+	want := map[string]int64{"a": 1, "c": 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir() = %v, want %v", got, want)
+	}
+
+	if _, err := m.Stat("b"); !os.IsNotExist(err) {
+		t.Errorf("Stat() of a whiteout file = %v, want not exist", err)
+	}
+}
+
+func TestMergedFSChroot(t *testing.T) {
+	upper := memfs.New()
+	m := NewWritableMergedFilesystem(upper,
+		newLayer(t, "a", 0, map[string]string{"a/x": "a", "b/y": "a"}, nil),
+		newLayer(t, "b", 0, map[string]string{"a/y": "b"}, nil),
+		newLayer(t, "c", 0, map[string]string{"c/z": "c"}, nil),
+	)
+
+	// the index of the parent is built before it's changed through the chroot
+	if got := readDirSizes(t, m, "a"); len(got) != 2 {
+		t.Fatalf("ReadDir() = %v, want x and y", got)
+	}
+
+	fs, err := m.Chroot("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := fs.(*MergedFS)
+
+	if exists(upper, "a") {
+		t.Error("Chroot() created the directory in the upper layer")
+	}
+
+	names := make([]string, 0)
+	for _, l := range c.Layers() {
+		names = append(names, l.Name)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Layers() = %v, want %v", names, want)
+	}
+
+	if got := c.Root(); got != "/a" {
+		t.Errorf("Root() = %q, want %q", got, "/a")
+	}
+
+	if got := readString(t, c, "y"); got != "b" {
+		t.Errorf("Open() = %q, want %q", got, "b")
+	}
+
+	if err := c.Remove("x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := util.WriteFile(c, "z", []byte("z"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := c.Open("z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Name() != "z" {
+		t.Errorf("Name() = %q, want %q", f.Name(), "z")
+	}
+
+	want := map[string]int64{"y": 1, "z": 1}
+	if got := readDirSizes(t, m, "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("parent ReadDir() = %v, want %v", got, want)
+	}
+
+	if _, err := m.Stat("a/x"); !os.IsNotExist(err) {
+		t.Errorf("parent Stat() of a removed file = %v, want not exist", err)
+	}
+
+	// changes to the parent are seen by the chroot
+	if err := m.Remove("a/y"); err != nil {
+		t.Fatal(err)
+	}
+
+	want = map[string]int64{"z": 1}
+	if got := readDirSizes(t, c, ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDir() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package vfs
+
+import (
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+const (
+	// WhiteoutPrefix is the prefix of a file that hides the file, or directory,
+	// with the rest of its name in all lower layers. For example, ".wh.main.go"
+	// hides "main.go".
+	WhiteoutPrefix = ".wh."
+
+	// WhiteoutOpaque is a file that hides the contents of the directory it is in
+	// from all lower layers, so that a layer can replace an entire directory.
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// IsWhiteout returns if a file name is a whiteout marker
+func IsWhiteout(name string) bool {
+	return strings.HasPrefix(name, WhiteoutPrefix)
+}
+
+// exists returns if a path exists in a filesystem, without following
+// symlinks
+func exists(fs billy.Filesystem, path string) bool {
+	_, err := fs.Lstat(path)
+	return err == nil
+}
+
+// HidesLower returns if a filesystem contains a whiteout that hides path, or
+// one of its parent directories, from the layers below it
+func HidesLower(fs billy.Filesystem, path string) bool {
+	segments := splitPath(path)
+
+	dir := ""
+	for _, seg := range segments {
+		if exists(fs, fs.Join(dir, WhiteoutOpaque)) || exists(fs, fs.Join(dir, WhiteoutPrefix+seg)) {
+			return true
+		}
+		dir = fs.Join(dir, seg)
+	}
+
+	return false
+}
+
+// isHidden returns if a path refers to a whiteout marker, which are never
+// visible through a MergedFS
+func isHidden(path string) bool {
+	segments := splitPath(path)
+	for _, seg := range segments {
+		if IsWhiteout(seg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitPath splits a path into its non-empty segments
+func splitPath(path string) []string {
+	segments := make([]string, 0)
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" && seg != "." {
+			segments = append(segments, seg)
+		}
+	}
+
+	return segments
+}
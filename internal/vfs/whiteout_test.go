@@ -0,0 +1,101 @@
+package vfs
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// newWhiteoutFS creates a MergedFS where the higher layer removes files, and
+// directories, of the lower layer with whiteouts
+func newWhiteoutFS(t *testing.T) *MergedFS {
+	return NewMergedFilesystem(
+		newLayer(t, "lower", 0, map[string]string{
+			"a/x": "lower", "a/y": "lower", "b/z": "lower", "c/w": "lower", "c/d/v": "lower",
+		}, nil),
+		newLayer(t, "higher", 1, map[string]string{
+			"a/.wh.x": "", ".wh.b": "", "c/.wh..wh..opq": "", "c/u": "higher",
+		}, nil),
+	)
+}
+
+func TestMergedFSWhiteouts(t *testing.T) {
+	tests := []struct {
+		path   string
+		hidden bool
+	}{
+		{path: "a/x", hidden: true},
+		{path: "a/y"},
+		{path: "b", hidden: true},
+		{path: "b/z", hidden: true},
+		{path: "c/w", hidden: true},
+		{path: "c/d", hidden: true},
+		{path: "c/d/v", hidden: true},
+		{path: "c/u"},
+		{path: "a/.wh.x", hidden: true},
+		{path: "c/.wh..wh..opq", hidden: true},
+	}
+
+	m := newWhiteoutFS(t)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			_, err := m.Stat(tt.path)
+			if tt.hidden && !os.IsNotExist(err) {
+				t.Errorf("Stat() = %v, want not exist", err)
+			} else if !tt.hidden && err != nil {
+				t.Errorf("Stat() = %v, want no error", err)
+			}
+
+			f, err := m.Open(tt.path)
+			if err == nil {
+				f.Close()
+			}
+
+			if tt.hidden && !os.IsNotExist(err) {
+				t.Errorf("Open() = %v, want not exist", err)
+			}
+		})
+	}
+}
+
+func TestMergedFSWhiteoutsReadDir(t *testing.T) {
+	m := newWhiteoutFS(t)
+
+	tests := map[string][]string{
+		"":  {"a", "c"},
+		"a": {"y"},
+		"c": {"u"},
+	}
+
+	for dir, want := range tests {
+		if got := listDir(t, m, dir); !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadDir(%q) = %v, want %v", dir, got, want)
+		}
+	}
+
+	if _, err := m.ReadDir("b"); !os.IsNotExist(err) {
+		t.Errorf("ReadDir() of a removed directory = %v, want not exist", err)
+	}
+}
+
+func TestMergedFSWhiteoutsWalk(t *testing.T) {
+	m := newWhiteoutFS(t)
+
+	got := make([]string, 0)
+	err := Walk(m, "", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		got = append(got, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"", "a", "a/y", "c", "c/u"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package codegen
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+)
+
+// editorConfigFile is the name of the EditorConfig file in a service
+const editorConfigFile = ".editorconfig"
+
+// editorConfig is a parsed EditorConfig file, see https://editorconfig.org
+type editorConfig struct {
+	sections []editorConfigSection
+}
+
+// editorConfigSection is a glob, and the properties of the files it matches
+type editorConfigSection struct {
+	glob       *regexp.Regexp
+	properties map[string]string
+}
+
+// readEditorConfig reads the EditorConfig file at the root of a service, returning
+// an empty one if it doesn't exist
+func readEditorConfig(fs billy.Filesystem) (*editorConfig, error) {
+	f, err := fs.Open(editorConfigFile)
+	if os.IsNotExist(err) {
+		return &editorConfig{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ec, err := parseEditorConfig(f)
+	return ec, errors.Wrapf(err, "failed to parse '%s'", editorConfigFile)
+}
+
+// parseEditorConfig parses an EditorConfig file, property names and values
+// are lowercased
+func parseEditorConfig(r io.Reader) (*editorConfig, error) {
+	ec := &editorConfig{sections: make([]editorConfigSection, 0)}
+
+	var section *editorConfigSection
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			glob, err := editorConfigGlob(line[1 : len(line)-1])
+			if err != nil {
+				return nil, err
+			}
+
+			ec.sections = append(ec.sections, editorConfigSection{glob: glob, properties: make(map[string]string)})
+			section = &ec.sections[len(ec.sections)-1]
+			continue
+		}
+
+		// properties before the first section, e.g. root, apply to no files
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || section == nil {
+			continue
+		}
+
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		section.properties[key] = strings.ToLower(strings.TrimSpace(kv[1]))
+	}
+
+	return ec, scanner.Err()
+}
+
+// editorConfigGlob converts an EditorConfig glob into a regular expression that
+// matches paths relative to the EditorConfig file
+func editorConfigGlob(glob string) (*regexp.Regexp, error) {
+	// globs without a separator match files in any directory
+	prefix := "^"
+	if !strings.Contains(glob, "/") {
+		prefix = "^(?:.*/)?"
+	}
+	glob = strings.TrimPrefix(glob, "/")
+
+	var b strings.Builder
+	braces := 0
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '{':
+			b.WriteString("(?:")
+			braces++
+		case c == '}' && braces > 0:
+			b.WriteString(")")
+			braces--
+		case c == ',' && braces > 0:
+			b.WriteString("|")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end == -1 {
+				b.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return regexp.Compile(prefix + b.String() + "$")
+}
+
+// properties returns the properties that apply to a path, relative to the
+// service, later sections take precedence
+func (ec *editorConfig) properties(path string) map[string]string {
+	path = filepath.ToSlash(path)
+
+	props := make(map[string]string)
+	for _, s := range ec.sections {
+		if !s.glob.MatchString(path) {
+			continue
+		}
+
+		for k, v := range s.properties {
+			props[k] = v
+		}
+	}
+
+	return props
+}
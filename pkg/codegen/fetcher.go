@@ -1,8 +1,14 @@
 package codegen
 
 import (
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+
 	"github.com/go-git/go-billy/v5"
 	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
@@ -13,13 +19,24 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+const (
+	// localTemplatesDir is a directory, in a service, of templates that are
+	// layered on top of the service's template repositories
+	localTemplatesDir = ".bootstraper/templates"
+
+	// maxConcurrentDownloads is the maximum number of template repositories
+	// that are downloaded at once
+	maxConcurrentDownloads = 4
+)
+
 type Fetcher struct {
 	log logrus.FieldLogger
+	dir string
 	m   *ServiceManifest
 }
 
-func NewFetcher(log logrus.FieldLogger, m *ServiceManifest) *Fetcher {
-	return &Fetcher{log, m}
+func NewFetcher(log logrus.FieldLogger, dir string, m *ServiceManifest) *Fetcher {
+	return &Fetcher{log, dir, m}
 }
 
 func (f *Fetcher) DownloadRepository(r TemplateRepository) (billy.Filesystem, error) {
@@ -63,58 +80,185 @@ func (f *Fetcher) ParseRepositoryManifest(r TemplateRepository, fs billy.Filesys
 	return manifest, err
 }
 
-// ResolveDependencies resolved the dependencies of a given template repository.
-// It currently only supports one level dependency resolution and doesn't do any
-// smart logic for ordering other than first wins.
-func (f *Fetcher) ResolveDependencies(filesystems map[string]bool, r *TemplateRepositoryManifest) ([]billy.Filesystem, map[string]Argument, error) {
-	depFilesystems := make([]billy.Filesystem, 0)
-	args := make(map[string]Argument)
-	for _, d := range r.Dependencies {
-		// If the filesystem already exists, then we can just skip it
-		// since something already required it.
-		if _, ok := filesystems[d.GitURL]; ok {
-			continue
-		}
+// fetchedRepository is a template repository that has been downloaded
+type fetchedRepository struct {
+	layer    vfs.Layer
+	manifest *TemplateRepositoryManifest
+}
+
+// fetchRepository downloads a template repository and parses its manifest
+func (f *Fetcher) fetchRepository(d TemplateRepository) (*fetchedRepository, error) {
+	fs, err := f.DownloadRepository(d)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to download repository '%s'", d.GitURL)
+	}
 
-		fs, err := f.DownloadRepository(d)
+	mf, err := f.ParseRepositoryManifest(d, fs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse manifest of '%s'", d.GitURL)
+	}
+
+	// only mount the templates directory, so that repositories can keep
+	// their tests and documentation alongside it
+	if mf.TemplatesDir != "" {
+		fs, err = fs.Chroot(mf.TemplatesDir)
 		if err != nil {
-			return nil, nil, errors.Wrapf(err, "failed to download repository '%s'", d.GitURL)
+			return nil, errors.Wrapf(err, "failed to use templates directory of '%s'", d.GitURL)
 		}
-		filesystems[d.GitURL] = true
+	}
+
+	return &fetchedRepository{
+		layer: vfs.Layer{
+			Name:     d.GitURL,
+			Version:  d.Version,
+			Priority: d.Priority,
+			FS:       fs,
+		},
+		manifest: mf,
+	}, nil
+}
 
-		mf, err := f.ParseRepositoryManifest(d, fs)
+// fetchRepositories downloads template repositories concurrently, across at most
+// maxConcurrentDownloads workers, returning them in the order they were provided.
+// If any fail to download, all of their errors are returned.
+func (f *Fetcher) fetchRepositories(repos []TemplateRepository) ([]*fetchedRepository, error) {
+	fetched := make([]*fetchedRepository, len(repos))
+	errs := make([]error, len(repos))
+
+	sem := make(chan struct{}, maxConcurrentDownloads)
+	wg := sync.WaitGroup{}
+	for i := range repos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			fetched[i], errs[i] = f.fetchRepository(repos[i])
+		}(i)
+	}
+	wg.Wait()
+
+	merr := make(vfs.MultiError, 0)
+	for _, err := range errs {
 		if err != nil {
-			return nil, nil, err
+			merr = append(merr, err)
 		}
-		for k, v := range mf.Arguments {
-			args[k] = v
+	}
+	if len(merr) != 0 {
+		return nil, merr
+	}
+
+	return fetched, nil
+}
+
+// ResolveDependencies resolves the dependencies of a given template repository, and
+// their dependencies. Repositories at the same depth of the dependency graph are
+// downloaded concurrently, and a repository that is depended on more than once is
+// only downloaded the first time that it's found. Every dependency is returned before
+// the first repository that depends on it, so that the latter takes precedence, and
+// otherwise in the order that they were declared. The manifests of every repository
+// are merged, in the same order, into the returned one.
+func (f *Fetcher) ResolveDependencies(filesystems map[string]bool, r *TemplateRepositoryManifest) ([]vfs.Layer, *TemplateRepositoryManifest, error) {
+	fetched := make(map[string]*fetchedRepository)
+	for deps := r.Dependencies; len(deps) != 0; {
+		// If the filesystem already exists, then we can just skip it
+		// since something already required it.
+		repos := make([]TemplateRepository, 0, len(deps))
+		for _, d := range deps {
+			if _, ok := filesystems[d.GitURL]; ok {
+				continue
+			}
+			filesystems[d.GitURL] = true
+			repos = append(repos, d)
 		}
 
-		subDepFilesystems, args, err := f.ResolveDependencies(filesystems, mf)
+		depth, err := f.fetchRepositories(repos)
 		if err != nil {
 			return nil, nil, err
 		}
-		for k, v := range args {
-			args[k] = v
+
+		deps = make([]TemplateRepository, 0)
+		for _, fr := range depth {
+			fetched[fr.layer.Name] = fr
+			deps = append(deps, fr.manifest.Dependencies...)
+		}
+	}
+
+	// dependencies are layered first, so that the arguments, files, post-processors,
+	// merge rules, and hooks of the repositories that depend on them take precedence
+	layers := make([]vfs.Layer, 0, len(fetched))
+	merged := &TemplateRepositoryManifest{
+		Arguments:      make(map[string]Argument),
+		PostProcessors: make([]PostProcessorConfig, 0),
+		Merge:          make([]MergeRule, 0),
+	}
+
+	visited := make(map[string]bool)
+	var visit func(deps []TemplateRepository)
+	visit = func(deps []TemplateRepository) {
+		for _, d := range deps {
+			fr, ok := fetched[d.GitURL]
+			if !ok || visited[d.GitURL] {
+				continue
+			}
+			visited[d.GitURL] = true
+
+			visit(fr.manifest.Dependencies)
+			layers = append(layers, fr.layer)
+			mergeManifest(merged, fr.manifest, fr.layer.String())
 		}
+	}
+	visit(r.Dependencies)
+
+	return layers, merged, nil
+}
 
-		// append the resolved dependencies of the sub-dependencies to the array of dependencies
-		// of the manifest we're operating on. Be sure to put the filesystem of this dependency after
-		// it's sub-dependencies.
-		depFilesystems = append(depFilesystems, append(subDepFilesystems, fs)...)
+// mergeManifest merges the manifest of a template repository into dst, replacing
+// the arguments it already has, and adding its post-processors, merge rules and hooks
+func mergeManifest(dst, src *TemplateRepositoryManifest, repository string) {
+	for k, v := range src.Arguments {
+		dst.Arguments[k] = v
+	}
+	dst.PostProcessors = append(dst.PostProcessors, src.PostProcessors...)
+	dst.Merge = append(dst.Merge, src.Merge...)
+	dst.Hooks.PreRender = append(dst.Hooks.PreRender, repositoryHooks(repository, src.Hooks.PreRender)...)
+	dst.Hooks.PostRender = append(dst.Hooks.PostRender, repositoryHooks(repository, src.Hooks.PostRender)...)
+}
+
+// repositoryHooks returns hooks with the repository that declared them
+func repositoryHooks(repository string, hooks []Hook) []Hook {
+	out := make([]Hook, len(hooks))
+	for i, h := range hooks {
+		h.repository = repository
+		out[i] = h
 	}
 
-	return depFilesystems, args, nil
+	return out
 }
 
-func (f *Fetcher) CreateVFS() (billy.Filesystem, map[string]Argument, error) {
+// CreateVFS creates a filesystem of every template repository that the service
+// uses, and returns it with their merged manifest
+func (f *Fetcher) CreateVFS() (billy.Filesystem, *TemplateRepositoryManifest, error) {
 	// Create a shim template manifest from our service dependencies
-	layers, args, err := f.ResolveDependencies(make(map[string]bool), &TemplateRepositoryManifest{
+	layers, mf, err := f.ResolveDependencies(make(map[string]bool), &TemplateRepositoryManifest{
 		Dependencies: f.m.Repositories,
 	})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return vfs.NewMergedFilesystem(layers...), args, nil
+	// Templates in the service itself are layered on top of everything else so
+	// that they can replace templates from the template repositories.
+	localDir := filepath.Join(f.dir, localTemplatesDir)
+	// Why: We're fine shadowing err.
+	//nolint:govet
+	if info, err := os.Stat(localDir); err == nil && info.IsDir() {
+		f.log.Infof("Using local templates from '%s'", localTemplatesDir)
+		layers = append(layers, vfs.Layer{Name: localTemplatesDir, Priority: math.MaxInt32, FS: osfs.New(localDir)})
+	}
+
+	return vfs.NewMergedFilesystem(layers...), mf, nil
 }
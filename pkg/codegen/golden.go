@@ -0,0 +1,283 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tritonmedia/bootstraper/internal/vfs"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// testsDir is the directory, in a template repository, of its test cases
+	testsDir = "tests"
+
+	// testManifest is the service manifest of a test case
+	testManifest = "service.yaml"
+
+	// testServiceDir is the directory, in a test case, of the files that the
+	// service has before it's rendered
+	testServiceDir = "service"
+
+	// testExpectedDir is the directory, in a test case, of the files that
+	// the service should have after it's rendered
+	testExpectedDir = "expected"
+)
+
+// TestResult is the result of a test case of a template repository
+type TestResult struct {
+	// Name is the name of the test case's directory
+	Name string
+
+	// Diffs are how the rendered files differ from the expected files
+	Diffs []string
+
+	// Err is the error that rendering failed with, if it did
+	Err error
+}
+
+// Passed returns true if the test case rendered the expected files
+func (t *TestResult) Passed() bool {
+	return t.Err == nil && len(t.Diffs) == 0
+}
+
+// RunTests renders every test case of the template repository in dir, and compares
+// the result to the expected files of the test case. A test case is a directory
+// in tests/ with a service.yaml, whose repositories are ignored, an optional directory,
+// service/, of the files the service already has, and a directory, expected/, of the
+// files the service should have after rendering. Hooks aren't run. If update is set
+// then the expected files are replaced with the rendered files instead. The repository
+// must keep its templates in a templatesDir, so that its tests aren't rendered.
+func RunTests(ctx context.Context, log logrus.FieldLogger, dir string, update bool) ([]*TestResult, error) {
+	f := NewFetcher(log, dir, nil)
+
+	repo := TemplateRepository{GitURL: dir}
+	manifest, err := f.ParseRepositoryManifest(repo, osfs.New(dir))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse manifest")
+	}
+
+	// otherwise the test cases would be rendered along with the templates
+	rel, err := filepath.Rel(filepath.Clean(manifest.TemplatesDir), testsDir)
+	if manifest.TemplatesDir == "" || err != nil || !strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("templatesDir must be set to a directory that doesn't contain %s/ to run tests", testsDir)
+	}
+
+	fs, err := osfs.New(dir).Chroot(manifest.TemplatesDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to use templates directory")
+	}
+
+	// the repository is layered on top of its dependencies, like it
+	// would be in a service
+	layers, mf, err := f.ResolveDependencies(map[string]bool{dir: true}, manifest)
+	if err != nil {
+		return nil, err
+	}
+	layer := vfs.Layer{Name: dir, FS: fs}
+	layers = append(layers, layer)
+	mergeManifest(mf, manifest, layer.String())
+	templates := vfs.NewMergedFilesystem(layers...)
+
+	cases, err := ioutil.ReadDir(filepath.Join(dir, testsDir))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read test cases")
+	}
+
+	results := make([]*TestResult, 0)
+	for _, c := range cases {
+		if !c.IsDir() {
+			continue
+		}
+
+		caseDir := filepath.Join(dir, testsDir, c.Name())
+		result := &TestResult{Name: c.Name(), Diffs: make([]string, 0)}
+		results = append(results, result)
+
+		out, err := renderTestCase(ctx, log.WithField("test", c.Name()), caseDir, templates, mf)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+
+		expectedDir := filepath.Join(caseDir, testExpectedDir)
+		if update {
+			result.Err = updateGoldenFiles(out, expectedDir)
+			continue
+		}
+
+		result.Diffs, result.Err = diffGoldenFiles(out, osfs.New(expectedDir))
+	}
+
+	return results, nil
+}
+
+// renderTestCase renders the service of a test case into an in-memory filesystem,
+// which starts with the files of its service directory
+func renderTestCase(ctx context.Context, log logrus.FieldLogger, caseDir string,
+	templates billy.Filesystem, mf *TemplateRepositoryManifest) (billy.Filesystem, error) {
+	b, err := ioutil.ReadFile(filepath.Join(caseDir, testManifest))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", testManifest)
+	}
+
+	var m *ServiceManifest
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", testManifest)
+	}
+
+	out := memfs.New()
+	if err := copyTree(out, osfs.New(filepath.Join(caseDir, testServiceDir))); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", testServiceDir)
+	}
+
+	r := newRenderer(log, "master", caseDir, m, out)
+	if err := r.configure(mf); err != nil {
+		return nil, err
+	}
+
+	return out, r.GenerateFiles(ctx, templates)
+}
+
+// readTree reads every file in a filesystem, by path
+func readTree(fs billy.Filesystem) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	err := vfs.Walk(fs, "", func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == "" {
+			return filepath.SkipDir
+		} else if err != nil || info.IsDir() {
+			return err
+		}
+
+		files[filepath.ToSlash(path)], err = readFile(fs, path)
+		return err
+	})
+
+	return files, err
+}
+
+// copyTree copies every file in a filesystem, with its mode, into another
+func copyTree(dst, src billy.Filesystem) error {
+	files, err := readTree(src)
+	if err != nil {
+		return err
+	}
+
+	for path, data := range files {
+		info, err := src.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		if err := util.WriteFile(dst, path, data, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// diffGoldenFiles returns how the rendered files differ from the expected files,
+// sorted by path
+func diffGoldenFiles(out, expected billy.Filesystem) ([]string, error) {
+	got, err := readTree(out)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read rendered files")
+	}
+
+	want, err := readTree(expected)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read expected files")
+	}
+
+	paths := make([]string, 0, len(got)+len(want))
+	for path := range got {
+		paths = append(paths, path)
+	}
+	for path := range want {
+		if _, ok := got[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	diffs := make([]string, 0)
+	for _, path := range paths {
+		gotData, rendered := got[path]
+		wantData, expected := want[path]
+		switch {
+		case !rendered:
+			diffs = append(diffs, fmt.Sprintf("%s: expected, but wasn't rendered", path))
+		case !expected:
+			diffs = append(diffs, fmt.Sprintf("%s: rendered, but wasn't expected", path))
+		case !bytes.Equal(gotData, wantData):
+			diffs = append(diffs, diffLines(path, wantData, gotData))
+		}
+	}
+
+	return diffs, nil
+}
+
+// diffLines describes the first line that differs between two files
+func diffLines(path string, want, got []byte) string {
+	wantLines := strings.Split(string(want), "\n")
+	gotLines := strings.Split(string(got), "\n")
+
+	line := 0
+	for line < len(wantLines) && line < len(gotLines) && wantLines[line] == gotLines[line] {
+		line++
+	}
+
+	wantLine, gotLine := "<end of file>", "<end of file>"
+	if line < len(wantLines) {
+		wantLine = wantLines[line]
+	}
+	if line < len(gotLines) {
+		gotLine = gotLines[line]
+	}
+
+	return fmt.Sprintf("%s: differs at line %d\n  want: %s\n  got:  %s", path, line+1, wantLine, gotLine)
+}
+
+// updateGoldenFiles replaces the expected files of a test case with the
+// rendered files
+func updateGoldenFiles(out billy.Filesystem, expectedDir string) error {
+	files, err := readTree(out)
+	if err != nil {
+		return errors.Wrap(err, "failed to read rendered files")
+	}
+
+	if err := os.RemoveAll(expectedDir); err != nil {
+		return err
+	}
+
+	for path, data := range files {
+		mode := os.FileMode(0644)
+		if info, err := out.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+
+		fullPath := filepath.Join(expectedDir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(fullPath, data, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
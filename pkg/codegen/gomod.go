@@ -0,0 +1,78 @@
+package codegen
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/semver"
+)
+
+// mergeGoMod merges a rendered go.mod into the existing one. Modules that the
+// template requires are raised to at least the version that it requires, and
+// everything that the service added, e.g. requirements and replacements, is kept.
+func mergeGoMod(rule *mergeRule, path string, existing, rendered []byte) ([]byte, error) {
+	f, err := modfile.Parse(path, existing, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse existing file")
+	}
+
+	tmpl, err := modfile.Parse(path, rendered, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse rendered file")
+	}
+
+	if tmpl.Module != nil {
+		if err := f.AddModuleStmt(tmpl.Module.Mod.Path); err != nil {
+			return nil, err
+		}
+	}
+
+	if tmpl.Go != nil && (f.Go == nil || semver.Compare("v"+tmpl.Go.Version, "v"+f.Go.Version) > 0) {
+		if err := f.AddGoStmt(tmpl.Go.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	required := make(map[string]string)
+	for _, r := range f.Require {
+		required[r.Mod.Path] = r.Mod.Version
+	}
+
+	for _, r := range tmpl.Require {
+		v, ok := required[r.Mod.Path]
+		switch {
+		case !ok:
+			f.AddNewRequire(r.Mod.Path, r.Mod.Version, r.Indirect)
+		case semver.Compare(r.Mod.Version, v) > 0:
+			if err := f.AddRequire(r.Mod.Path, r.Mod.Version); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// the service's replacements take precedence over the template's
+	replaced := make(map[string]bool)
+	for _, r := range f.Replace {
+		replaced[r.Old.Path] = true
+	}
+
+	for _, r := range tmpl.Replace {
+		if replaced[r.Old.Path] {
+			continue
+		}
+
+		if err := f.AddReplace(r.Old.Path, r.Old.Version, r.New.Path, r.New.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, e := range tmpl.Exclude {
+		if err := f.AddExclude(e.Mod.Path, e.Mod.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	f.SortBlocks()
+	f.Cleanup()
+
+	return f.Format()
+}
@@ -0,0 +1,297 @@
+package codegen
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// defaultHookTimeout is how long a hook can run for, unless it sets
+	// its own timeout
+	defaultHookTimeout = 5 * time.Minute
+
+	// HookPreRender are hooks run before any file is written
+	HookPreRender = "preRender"
+
+	// HookPostRender are hooks run after every file was written
+	HookPostRender = "postRender"
+)
+
+// hookEnv are the environment variables that every hook receives, if
+// they're set
+var hookEnv = []string{"PATH", "HOME", "TMPDIR", "USER", "LANG"}
+
+// HookConsent is asked if a template repository may run hooks, the first time
+// that it wants to, or when its hooks change. It's given the hooks that the
+// repository would run.
+type HookConsent func(repository string, hooks []Hook) (bool, error)
+
+// HookReport is the result of running a hook
+type HookReport struct {
+	// Stage is when the hook was run, see the Hook* constants
+	Stage string `json:"stage"`
+
+	// Repository is the template repository that declared the hook
+	Repository string `json:"repository"`
+
+	Command []string `json:"command"`
+
+	// Error is the error the hook failed with, if it failed
+	Error string `json:"error,omitempty"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// repositoryHook is a hook, when it's run, and the repository that declared it
+type repositoryHook struct {
+	Hook
+
+	stage   string
+	timeout time.Duration
+}
+
+// SetHookConsent sets how consent to run hooks is asked for. Without it,
+// template repositories that have hooks fail to render until they are allowed.
+func (r *Renderer) SetHookConsent(ask HookConsent) {
+	r.hookConsent = ask
+}
+
+// enableHooks returns the hooks, in the order they should be run, of a stage
+// whose conditions are met
+func (r *Renderer) enableHooks(stage string, hooks []Hook) ([]repositoryHook, error) {
+	enabled := make([]repositoryHook, 0)
+	for _, hook := range hooks {
+		h := repositoryHook{Hook: hook, stage: stage}
+
+		if len(h.Command) == 0 {
+			return nil, fmt.Errorf("hook of '%s' has no command", h.repository)
+		}
+
+		h.timeout = defaultHookTimeout
+		if h.Timeout != "" {
+			var err error
+			if h.timeout, err = time.ParseDuration(h.Timeout); err != nil {
+				return nil, errors.Wrapf(err, "invalid timeout for hook '%s' of '%s'", h.Command[0], h.repository)
+			}
+		}
+
+		met := true
+		for arg, value := range h.If {
+			if r.m.Arguments[arg] != value {
+				met = false
+			}
+		}
+
+		if met {
+			enabled = append(enabled, h)
+		}
+	}
+
+	return enabled, nil
+}
+
+// checkHookConsent ensures that the user has allowed every repository with
+// hooks to run them
+func (r *Renderer) checkHookConsent(hooks []repositoryHook) error {
+	repoHooks := make(map[string][]Hook)
+	order := make([]string, 0)
+	for _, h := range hooks {
+		if _, ok := repoHooks[h.repository]; !ok {
+			order = append(order, h.repository)
+		}
+		repoHooks[h.repository] = append(repoHooks[h.repository], h.Hook)
+	}
+
+	if len(order) == 0 {
+		return nil
+	}
+
+	// this is only found when it's needed, since not every environment has
+	// a config directory
+	if r.consentPath == "" {
+		var err error
+		if r.consentPath, err = defaultConsentPath(); err != nil {
+			return errors.Wrap(err, "failed to find where to store hook consent")
+		}
+	}
+
+	consent, err := readHookConsent(r.consentPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to read hook consent")
+	}
+
+	changed := false
+	for _, repo := range order {
+		hash := hashHooks(repoHooks[repo])
+		if consent[repo] == hash {
+			continue
+		}
+
+		allowed := false
+		if r.hookConsent != nil {
+			if allowed, err = r.hookConsent(repo, repoHooks[repo]); err != nil {
+				return err
+			}
+		}
+
+		if !allowed {
+			return fmt.Errorf("template repository '%s' wants to run hooks, but hasn't been allowed to", repo)
+		}
+
+		consent[repo] = hash
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	return errors.Wrap(writeHookConsent(r.consentPath, consent), "failed to save hook consent")
+}
+
+// runHooks runs hooks, in order, in the service, stopping at the first
+// that fails
+func (r *Renderer) runHooks(ctx context.Context, hooks []repositoryHook) error {
+	for _, h := range hooks {
+		start := time.Now()
+		err := r.runHook(ctx, h)
+
+		report := &HookReport{
+			Stage:      h.stage,
+			Repository: h.repository,
+			Command:    h.Command,
+			Duration:   time.Since(start),
+		}
+		if err != nil {
+			report.Error = err.Error()
+		}
+		r.report.Hooks = append(r.report.Hooks, report)
+
+		if err != nil {
+			return errors.Wrapf(err, "%s hook '%s' of '%s' failed", h.stage, strings.Join(h.Command, " "), h.repository)
+		}
+	}
+
+	return nil
+}
+
+// runHook runs a hook, without a shell, in the service with a restricted
+// environment. The command must be available locally.
+func (r *Renderer) runHook(ctx context.Context, h repositoryHook) error {
+	bin, err := exec.LookPath(h.Command[0])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	env := make([]string, 0)
+	for _, k := range append(append([]string{}, hookEnv...), h.Env...) {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+
+	// Why: Commands are only run once the user has allowed them.
+	//nolint:gosec
+	cmd := exec.CommandContext(ctx, bin, h.Command[1:]...)
+	cmd.Dir = r.dir
+	cmd.Env = env
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	r.log.Infof("Running %s hook '%s'", h.stage, strings.Join(h.Command, " "))
+	err = cmd.Run()
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line != "" {
+			r.log.WithField("hook", h.Command[0]).Info(line)
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", h.timeout)
+	}
+
+	return err
+}
+
+// defaultConsentPath returns where consent to run hooks is stored
+func defaultConsentPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "bootstraper", "hooks.yaml"), nil
+}
+
+// readHookConsent reads the hooks that have been allowed, as a map of
+// repository to the hash of its hooks
+func readHookConsent(path string) (map[string]string, error) {
+	consent := make(map[string]string)
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return consent, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return consent, yaml.Unmarshal(b, &consent)
+}
+
+// writeHookConsent writes the hooks that have been allowed
+func writeHookConsent(path string, consent map[string]string) error {
+	b, err := yaml.Marshal(consent)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// hashHooks hashes the commands of hooks, the environment variables they receive,
+// and their conditions, so that changing any of them requires consent again
+func hashHooks(hooks []Hook) string {
+	h := sha256.New()
+	for _, hook := range hooks {
+		for _, arg := range hook.Command {
+			fmt.Fprintf(h, "%q ", arg)
+		}
+
+		h.Write([]byte("\nenv:"))
+		for _, k := range hook.Env {
+			fmt.Fprintf(h, " %q", k)
+		}
+
+		conditions := make([]string, 0, len(hook.If))
+		for arg, value := range hook.If {
+			conditions = append(conditions, fmt.Sprintf("%q=%q", arg, value))
+		}
+		sort.Strings(conditions)
+
+		fmt.Fprintf(h, "\nif: %s\n", strings.Join(conditions, " "))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
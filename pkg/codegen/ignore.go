@@ -0,0 +1,126 @@
+package codegen
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/pkg/errors"
+	"github.com/tritonmedia/bootstraper/internal/vfs"
+)
+
+// ignoreFile is a file, using gitignore syntax, that lists paths that should
+// not be written. In a template repository it matches template paths, in a
+// service it matches the paths that would be written.
+const ignoreFile = ".bootstraperignore"
+
+// readIgnoreFile reads the patterns of an ignore file at the root of
+// a filesystem, if it exists
+func readIgnoreFile(fs billy.Filesystem) ([]gitignore.Pattern, error) {
+	f, err := fs.Open(ignoreFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ps := make([]gitignore.Pattern, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ps = append(ps, gitignore.ParsePattern(line, nil))
+	}
+
+	return ps, scanner.Err()
+}
+
+// templateIgnores are the ignore files of every layer of a template filesystem.
+// The patterns of a layer only apply to the files that it provides, so that a
+// repository can't ignore the files of the repositories that depend on it.
+type templateIgnores struct {
+	fs billy.Filesystem
+
+	// layers maps the name of a layer to the patterns of its ignore file
+	layers map[string]gitignore.Matcher
+}
+
+// loadTemplateIgnores reads the ignore file of every layer of a filesystem
+func loadTemplateIgnores(fs billy.Filesystem) (*templateIgnores, error) {
+	mfs, ok := fs.(*vfs.MergedFS)
+	if !ok {
+		m, err := loadIgnore(fs)
+		return &templateIgnores{fs: fs, layers: map[string]gitignore.Matcher{"": m}}, err
+	}
+
+	t := &templateIgnores{fs: fs, layers: make(map[string]gitignore.Matcher)}
+	filesystems := layers(fs)
+	for i, l := range mfs.Layers() {
+		// a later layer can remove the ignore file with a whiteout
+		if hiddenAbove(filesystems, i, ignoreFile) {
+			continue
+		}
+
+		m, err := loadIgnore(l.FS)
+		if err != nil {
+			return nil, errors.Wrapf(err, "layer '%s'", l)
+		}
+		t.layers[l.Name] = m
+	}
+
+	return t, nil
+}
+
+// match returns if a path is ignored by the layer that provides it. Directories
+// can be provided by more than one layer, so they're only ignored if every
+// layer that provides them ignores them.
+func (t *templateIgnores) match(path string, isDir bool) bool {
+	if t == nil {
+		return false
+	}
+
+	mfs, ok := t.fs.(*vfs.MergedFS)
+	if !ok {
+		return isIgnored(t.layers[""], path, isDir)
+	}
+
+	p, err := mfs.Explain(path)
+	if err != nil {
+		return false
+	}
+
+	providers := []vfs.Layer{p.Layer}
+	if isDir {
+		providers = append(providers, p.Shadowed...)
+	}
+
+	for _, l := range providers {
+		if !isIgnored(t.layers[l.Name], path, isDir) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// loadIgnore creates a matcher from the ignore file at the root of
+// a filesystem
+func loadIgnore(fs billy.Filesystem) (gitignore.Matcher, error) {
+	ps, err := readIgnoreFile(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	return gitignore.NewMatcher(ps), nil
+}
+
+// isIgnored returns if a path is matched by an ignore matcher
+func isIgnored(m gitignore.Matcher, path string, isDir bool) bool {
+	return m != nil && m.Match(strings.Split(path, "/"), isDir)
+}
@@ -0,0 +1,473 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ListAppend adds the items of a rendered list that aren't already in
+	// the existing list to the end of it
+	ListAppend = "append"
+
+	// ListReplace replaces the existing list with the rendered one
+	ListReplace = "replace"
+
+	// ListKeyed merges the items of lists of maps that have the same value
+	// for a key, and appends the rest
+	ListKeyed = "keyed"
+)
+
+// mergeFunc merges a rendered file into the existing file at path
+type mergeFunc func(rule *mergeRule, path string, existing, rendered []byte) ([]byte, error)
+
+// mergers are the strategies that rendered files can be merged with, by name
+var mergers = map[string]mergeFunc{
+	"yaml":  mergeYAML,
+	"json":  mergeJSON,
+	"gomod": mergeGoMod,
+}
+
+// mergeRule is a MergeRule that's ready to be used
+type mergeRule struct {
+	MergeRule
+
+	files gitignore.Matcher
+}
+
+// compileMergeRules validates the merge rules of template repositories
+func compileMergeRules(rules []MergeRule) ([]*mergeRule, error) {
+	compiled := make([]*mergeRule, len(rules))
+	for i, rule := range rules {
+		if _, ok := mergers[rule.Strategy]; !ok && rule.Strategy != "" {
+			return nil, fmt.Errorf("unknown merge strategy '%s'", rule.Strategy)
+		}
+
+		for _, l := range rule.Lists {
+			switch l.Strategy {
+			case ListAppend, ListReplace:
+			case ListKeyed:
+				if l.Key == "" {
+					return nil, fmt.Errorf("list '%s' is merged by key, but has no key", l.Path)
+				}
+			default:
+				return nil, fmt.Errorf("invalid strategy '%s' for list '%s', expected '%s', '%s' or '%s'",
+					l.Strategy, l.Path, ListAppend, ListReplace, ListKeyed)
+			}
+		}
+
+		ps := make([]gitignore.Pattern, len(rule.Files))
+		for j, glob := range rule.Files {
+			ps[j] = gitignore.ParsePattern(glob, nil)
+		}
+
+		compiled[i] = &mergeRule{MergeRule: rule, files: gitignore.NewMatcher(ps)}
+	}
+
+	return compiled, nil
+}
+
+// mergeRuleFor returns the rule for a path, later rules take precedence,
+// or an empty rule if none match
+func (r *Renderer) mergeRuleFor(path string) *mergeRule {
+	for i := len(r.mergeRules) - 1; i >= 0; i-- {
+		if isIgnored(r.mergeRules[i].files, path, false) {
+			return r.mergeRules[i]
+		}
+	}
+
+	return &mergeRule{}
+}
+
+// merge merges a rendered file into the file that already exists in the
+// service, if its template, or a merge rule, asked for it
+func (r *Renderer) merge(rf *renderedFile) error {
+	rule := r.mergeRuleFor(rf.path)
+
+	strategy := rf.merge
+	if strategy == "" {
+		strategy = rule.Strategy
+	}
+
+	if strategy == "" {
+		return nil
+	}
+
+	mergeFn, ok := mergers[strategy]
+	if !ok {
+		return fmt.Errorf("unknown merge strategy '%s'", strategy)
+	}
+
+	existing, err := readFile(r.out, rf.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	data, err := mergeFn(rule, rf.path, existing, rf.data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to merge '%s' into the existing file", rf.path)
+	}
+	rf.data = data
+
+	return nil
+}
+
+// mergeYAML deep merges every document of a rendered YAML file into the
+// same document of the existing file, keeping the comments of both. Existing
+// documents that weren't rendered are kept, so rendering nothing leaves the
+// file as it is.
+func mergeYAML(rule *mergeRule, path string, existing, rendered []byte) ([]byte, error) {
+	existingDocs, err := decodeYAML(existing)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse existing file")
+	}
+
+	renderedDocs, err := decodeYAML(rendered)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse rendered file")
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	for i := 0; i < len(existingDocs) || i < len(renderedDocs); i++ {
+		var doc *yaml.Node
+		switch {
+		case i >= len(renderedDocs):
+			doc = existingDocs[i]
+		case i >= len(existingDocs):
+			doc = renderedDocs[i]
+		default:
+			doc = rule.mergeNode(nil, existingDocs[i], renderedDocs[i])
+		}
+
+		if err := enc.Encode(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// mergeJSON deep merges a rendered JSON file into the existing file, like
+// mergeYAML, rendering nothing leaves the file as it is
+func mergeJSON(rule *mergeRule, path string, existing, rendered []byte) ([]byte, error) {
+	// JSON is YAML, so the same merge can be used for both
+	var existingDoc, renderedDoc yaml.Node
+	if err := yaml.Unmarshal(existing, &existingDoc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse existing file")
+	}
+
+	if err := yaml.Unmarshal(rendered, &renderedDoc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse rendered file")
+	}
+
+	if len(renderedDoc.Content) == 0 {
+		return existing, nil
+	}
+
+	var buf bytes.Buffer
+	if err := encodeJSON(&buf, rule.mergeNode(nil, &existingDoc, &renderedDoc)); err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, buf.Bytes(), "", "  "); err != nil {
+		return nil, err
+	}
+	out.WriteString("\n")
+
+	return out.Bytes(), nil
+}
+
+// decodeYAML decodes every document of a YAML file
+func decodeYAML(data []byte) ([]*yaml.Node, error) {
+	docs := make([]*yaml.Node, 0)
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var n yaml.Node
+		err := dec.Decode(&n)
+		if err == io.EOF {
+			return docs, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		docs = append(docs, &n)
+	}
+}
+
+// mergeNode merges the rendered value of the key at path into its existing value.
+// Maps are merged key by key, where rendered values replace existing ones and keys
+// that are only in the existing map are kept, unless the template owns them. Lists
+// are merged based on the rule's list strategy, replacing them by default.
+func (rule *mergeRule) mergeNode(path []string, existing, rendered *yaml.Node) *yaml.Node {
+	switch {
+	case existing == nil:
+		return rendered
+	case rule.owns(rule.UserOwned, path):
+		return existing
+	case rule.owns(rule.TemplateOwned, path):
+		return rendered
+	}
+
+	if existing.Kind != rendered.Kind {
+		return rendered
+	}
+
+	switch rendered.Kind {
+	case yaml.DocumentNode:
+		if len(existing.Content) == 0 || len(rendered.Content) == 0 {
+			return rendered
+		}
+
+		merged := *existing
+		merged.Content = []*yaml.Node{rule.mergeNode(path, existing.Content[0], rendered.Content[0])}
+		return &merged
+	case yaml.MappingNode:
+		return rule.mergeMap(path, existing, rendered)
+	case yaml.SequenceNode:
+		return rule.mergeList(path, existing, rendered)
+	case yaml.ScalarNode:
+		// keep the comments, and style, of the existing value
+		merged := *existing
+		merged.Tag = rendered.Tag
+		merged.Value = rendered.Value
+		if existing.ShortTag() != rendered.ShortTag() {
+			merged.Style = rendered.Style
+		}
+		return &merged
+	}
+
+	return rendered
+}
+
+// mergeMap merges a rendered map into an existing one, keeping the order
+// of the existing keys
+func (rule *mergeRule) mergeMap(path []string, existing, rendered *yaml.Node) *yaml.Node {
+	merged := *existing
+	merged.Content = make([]*yaml.Node, 0, len(existing.Content)+len(rendered.Content))
+
+	renderedValues := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(rendered.Content); i += 2 {
+		renderedValues[rendered.Content[i].Value] = rendered.Content[i+1]
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(existing.Content); i += 2 {
+		key, value := existing.Content[i], existing.Content[i+1]
+		keyPath := append(append([]string{}, path...), key.Value)
+		seen[key.Value] = true
+
+		renderedValue, ok := renderedValues[key.Value]
+		if !ok {
+			// keys that the template owns, but no longer renders, are removed
+			if rule.owns(rule.TemplateOwned, keyPath) {
+				continue
+			}
+
+			merged.Content = append(merged.Content, key, value)
+			continue
+		}
+
+		merged.Content = append(merged.Content, key, rule.mergeNode(keyPath, value, renderedValue))
+	}
+
+	for i := 0; i+1 < len(rendered.Content); i += 2 {
+		if !seen[rendered.Content[i].Value] {
+			merged.Content = append(merged.Content, rendered.Content[i], rendered.Content[i+1])
+		}
+	}
+
+	return &merged
+}
+
+// mergeList merges a rendered list into an existing one
+func (rule *mergeRule) mergeList(path []string, existing, rendered *yaml.Node) *yaml.Node {
+	l := rule.list(path)
+	if l == nil || l.Strategy == ListReplace {
+		return rendered
+	}
+
+	merged := *existing
+	merged.Content = append([]*yaml.Node{}, existing.Content...)
+
+	for _, item := range rendered.Content {
+		found := -1
+		for i, existingItem := range merged.Content {
+			if l.Strategy == ListKeyed && sameKey(l.Key, existingItem, item) {
+				found = i
+				break
+			}
+
+			if l.Strategy == ListAppend && nodeEqual(existingItem, item) {
+				found = i
+				break
+			}
+		}
+
+		switch {
+		case found == -1:
+			merged.Content = append(merged.Content, item)
+		case l.Strategy == ListKeyed:
+			merged.Content[found] = rule.mergeNode(path, merged.Content[found], item)
+		}
+	}
+
+	return &merged
+}
+
+// owns returns true if a key path is, or is inside of, one of the given paths
+func (rule *mergeRule) owns(paths []string, path []string) bool {
+	for _, p := range paths {
+		if matchKeyPath(strings.Split(p, "."), path, true) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// list returns the rule for the list at a key path, if there is one
+func (rule *mergeRule) list(path []string) *ListRule {
+	for i := range rule.Lists {
+		if matchKeyPath(strings.Split(rule.Lists[i].Path, "."), path, false) {
+			return &rule.Lists[i]
+		}
+	}
+
+	return nil
+}
+
+// matchKeyPath returns true if a key path matches a pattern, where a "*"
+// segment matches any key. If prefix is true, then paths inside of the
+// pattern also match.
+func matchKeyPath(pattern, path []string, prefix bool) bool {
+	if len(path) < len(pattern) || (!prefix && len(path) != len(pattern)) {
+		return false
+	}
+
+	for i, seg := range pattern {
+		if seg != "*" && seg != path[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameKey returns true if two maps have the same value for a key
+func sameKey(key string, a, b *yaml.Node) bool {
+	av, bv := mapValue(a, key), mapValue(b, key)
+	return av != nil && bv != nil && nodeEqual(av, bv)
+}
+
+// mapValue returns the value of a key in a map, or nil if it's not
+// a map or doesn't have the key
+func mapValue(n *yaml.Node, key string) *yaml.Node {
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// nodeEqual returns true if two nodes have the same value, ignoring
+// their style and comments
+func nodeEqual(a, b *yaml.Node) bool {
+	if a.Kind == yaml.AliasNode {
+		a = a.Alias
+	}
+
+	if b.Kind == yaml.AliasNode {
+		b = b.Alias
+	}
+
+	if a.Kind != b.Kind || a.ShortTag() != b.ShortTag() || a.Value != b.Value || len(a.Content) != len(b.Content) {
+		return false
+	}
+
+	for i := range a.Content {
+		if !nodeEqual(a.Content[i], b.Content[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeJSON writes a YAML node as compact JSON, keeping the order of maps
+func encodeJSON(w *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		return encodeJSON(w, n.Content[0])
+	case yaml.AliasNode:
+		return encodeJSON(w, n.Alias)
+	case yaml.MappingNode:
+		w.WriteString("{")
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i != 0 {
+				w.WriteString(",")
+			}
+
+			key, err := json.Marshal(n.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			w.Write(key)
+			w.WriteString(":")
+
+			if err := encodeJSON(w, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		w.WriteString("}")
+	case yaml.SequenceNode:
+		w.WriteString("[")
+		for i, item := range n.Content {
+			if i != 0 {
+				w.WriteString(",")
+			}
+
+			if err := encodeJSON(w, item); err != nil {
+				return err
+			}
+		}
+		w.WriteString("]")
+	case yaml.ScalarNode:
+		switch n.ShortTag() {
+		case "!!null":
+			w.WriteString("null")
+		case "!!bool", "!!int", "!!float":
+			w.WriteString(n.Value)
+		default:
+			b, err := json.Marshal(n.Value)
+			if err != nil {
+				return err
+			}
+			w.Write(b)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package codegen
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMergeYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     MergeRule
+		existing string
+		rendered string
+		want     string
+	}{
+		{
+			name:     "map",
+			existing: "a: 1 # existing\nb: 2\n",
+			rendered: "c: 3\na: 4\n",
+			want:     "a: 4 # existing\nb: 2\nc: 3\n",
+		},
+		{
+			name:     "list is replaced by default",
+			existing: "l: [a, b]\n",
+			rendered: "l: [c]\n",
+			want:     "l: [c]\n",
+		},
+		{
+			name:     "list append",
+			rule:     MergeRule{Lists: []ListRule{{Path: "l", Strategy: ListAppend}}},
+			existing: "l:\n  - a\n  - b\n",
+			rendered: "l:\n  - b\n  - c\n",
+			want:     "l:\n  - a\n  - b\n  - c\n",
+		},
+		{
+			name:     "keyed list",
+			rule:     MergeRule{Lists: []ListRule{{Path: "*.services", Strategy: ListKeyed, Key: "name"}}},
+			existing: "x:\n  services:\n    - name: a\n      port: 1\n      user: true\n    - name: b\n",
+			rendered: "x:\n  services:\n    - name: a\n      port: 2\n    - name: c\n",
+			want:     "x:\n  services:\n    - name: a\n      port: 2\n      user: true\n    - name: b\n    - name: c\n",
+		},
+		{
+			name:     "owned keys",
+			rule:     MergeRule{TemplateOwned: []string{"run"}, UserOwned: []string{"issues"}},
+			existing: "run:\n  timeout: 1m\n  user: true\nissues:\n  max: 1\n",
+			rendered: "run:\n  timeout: 5m\nissues:\n  max: 10\n",
+			want:     "run:\n  timeout: 5m\nissues:\n  max: 1\n",
+		},
+		{
+			name:     "template owned key that isn't rendered",
+			rule:     MergeRule{TemplateOwned: []string{"run"}},
+			existing: "run: a\nb: c\n",
+			rendered: "b: d\n",
+			want:     "b: d\n",
+		},
+		{
+			name:     "documents that aren't rendered are kept",
+			existing: "a: 1\n---\nb: 2\n---\nc: 3\n",
+			rendered: "a: 4\n",
+			want:     "a: 4\n---\nb: 2\n---\nc: 3\n",
+		},
+		{
+			name:     "new documents are added",
+			existing: "a: 1\n",
+			rendered: "a: 2\n---\nb: 3\n",
+			want:     "a: 2\n---\nb: 3\n",
+		},
+		{
+			name:     "empty render",
+			existing: "a: 1\n---\nb: 2\n",
+			rendered: "",
+			want:     "a: 1\n---\nb: 2\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileMergeRules([]MergeRule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := mergeYAML(rules[0], "file.yaml", []byte(tt.existing), []byte(tt.rendered))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("mergeYAML() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     MergeRule
+		existing string
+		rendered string
+		want     string
+	}{
+		{
+			name:     "map",
+			existing: `{"b": 1, "a": {"x": true}}`,
+			rendered: `{"a": {"y": null}, "c": "d"}`,
+			want:     "{\n  \"b\": 1,\n  \"a\": {\n    \"x\": true,\n    \"y\": null\n  },\n  \"c\": \"d\"\n}\n",
+		},
+		{
+			name:     "keyed list",
+			rule:     MergeRule{Lists: []ListRule{{Path: "l", Strategy: ListKeyed, Key: "id"}}},
+			existing: `{"l": [{"id": 1, "v": "a"}, {"id": 2}]}`,
+			rendered: `{"l": [{"id": 1, "v": "b"}, {"id": 3}]}`,
+			want:     "{\n  \"l\": [\n    {\n      \"id\": 1,\n      \"v\": \"b\"\n    },\n    {\n      \"id\": 2\n    },\n    {\n      \"id\": 3\n    }\n  ]\n}\n",
+		},
+		{
+			name:     "empty render",
+			existing: `{"a": 1}`,
+			rendered: "",
+			want:     `{"a": 1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileMergeRules([]MergeRule{tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := mergeJSON(rules[0], "file.json", []byte(tt.existing), []byte(tt.rendered))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("mergeJSON() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{
+			name: "scalars",
+			yaml: "s: yes\nq: \"1\"\ni: 1\nf: 1.5\nb: true\nn: null\n",
+			want: `{"s":"yes","q":"1","i":1,"f":1.5,"b":true,"n":null}`,
+		},
+		{
+			name: "keys keep their order",
+			yaml: "z: [1, {a: b}]\na: []\n",
+			want: `{"z":[1,{"a":"b"}],"a":[]}`,
+		},
+		{
+			name: "alias",
+			yaml: "a: &x {b: c}\nd: *x\n",
+			want: `{"a":{"b":"c"},"d":{"b":"c"}}`,
+		},
+		{
+			name: "escaped string",
+			yaml: "a: \"quote \\\" and <tag>\"\n",
+			want: `{"a":"quote \" and \u003ctag\u003e"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.yaml), &n); err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			if err := encodeJSON(&buf, &n); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := buf.String(); got != tt.want {
+				t.Errorf("encodeJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeGoMod(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		rendered string
+		want     string
+	}{
+		{
+			name:     "requirements are raised, never lowered",
+			existing: "module a\n\ngo 1.15\n\nrequire (\n\texample.com/x v1.2.0\n\texample.com/y v1.0.0\n)\n",
+			rendered: "module a\n\ngo 1.14\n\nrequire (\n\texample.com/x v1.1.0\n\texample.com/y v1.1.0\n\texample.com/z v0.1.0\n)\n",
+			want:     "module a\n\ngo 1.15\n\nrequire (\n\texample.com/x v1.2.0\n\texample.com/y v1.1.0\n\texample.com/z v0.1.0\n)\n",
+		},
+		{
+			name:     "go version is raised",
+			existing: "module a\n\ngo 1.14\n",
+			rendered: "module a\n\ngo 1.16\n",
+			want:     "module a\n\ngo 1.16\n",
+		},
+		{
+			name:     "service replacements are kept",
+			existing: "module a\n\ngo 1.15\n\nreplace example.com/x => ../x\n",
+			rendered: "module a\n\ngo 1.15\n\nreplace example.com/x => example.com/fork v1.0.0\n\nreplace example.com/y => ../y\n",
+			want:     "module a\n\ngo 1.15\n\nreplace example.com/x => ../x\n\nreplace example.com/y => ../y\n",
+		},
+		{
+			name:     "module is renamed",
+			existing: "module a\n\ngo 1.15\n",
+			rendered: "module b\n",
+			want:     "module b\n\ngo 1.15\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeGoMod(&mergeRule{}, "go.mod", []byte(tt.existing), []byte(tt.rendered))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("mergeGoMod() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
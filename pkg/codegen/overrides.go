@@ -0,0 +1,79 @@
+package codegen
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// override returns the FileOverride for a given output path, if the service
+// has one
+func (r *Renderer) override(path string) *FileOverride {
+	if o, ok := r.m.Files[path]; ok && o != nil {
+		return o
+	}
+
+	return nil
+}
+
+// readOverrideTemplate reads the template that a service uses in place of the one
+// that would be written to a given path, returning its path and contents, or nil
+// if it doesn't have one
+func (r *Renderer) readOverrideTemplate(path string) (string, []byte, error) {
+	o := r.override(path)
+	if o == nil || o.Template == "" {
+		return "", nil, nil
+	}
+
+	b, err := readFile(r.out, o.Template)
+	return o.Template, b, errors.Wrapf(err, "failed to read override template for '%s'", path)
+}
+
+// renderOverrideTemplate renders the template that a service uses in place of
+// the one that produced a rendered file, returning the files it produced, or
+// the rendered file if the service doesn't have one
+func (r *Renderer) renderOverrideTemplate(rf *renderedFile) ([]*renderedFile, error) {
+	source, data, err := r.readOverrideTemplate(rf.path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file was already rendered from the override template
+	if data == nil || source == rf.source {
+		return []*renderedFile{rf}, nil
+	}
+
+	files, err := r.execTemplate(source, rf.path, data, rf.mode, rf.args)
+	return files, errors.Wrap(err, "failed to render override template")
+}
+
+// applyOverride changes a rendered file based on the service's override for it
+func (r *Renderer) applyOverride(rf *renderedFile) error {
+	o := r.override(rf.path)
+	if o == nil {
+		return nil
+	}
+
+	if o.Skip {
+		rf.write = false
+	}
+
+	if o.Static {
+		rf.static = true
+	}
+
+	if o.Mode != "" {
+		mode, err := strconv.ParseUint(o.Mode, 8, 32)
+		if err != nil {
+			return errors.Wrapf(err, "invalid mode for '%s'", rf.path)
+		}
+		rf.modeOverride = os.FileMode(mode)
+	}
+
+	if o.OutputPath != "" {
+		rf.path = o.OutputPath
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package codegen
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/pkg/errors"
+	"github.com/tritonmedia/bootstraper/internal/vfs"
+)
+
+const (
+	// partialsDir is a directory, at the root of a template repository, that
+	// contains templates that are shared with every other template
+	partialsDir = "_partials"
+
+	// partialSuffix is the suffix of a template that is shared with every other
+	// template, regardless of where it is located
+	partialSuffix = ".tpl.inc"
+)
+
+// isPartial returns if a given path is a partial and should be made available
+// to other templates instead of being rendered
+func isPartial(path string) bool {
+	return strings.HasSuffix(path, partialSuffix) ||
+		path == partialsDir || strings.HasPrefix(path, partialsDir+"/")
+}
+
+// loadPartials parses the partials of every layer of a filesystem into
+// a shared template set. Layers are loaded in order, so a partial that is
+// defined in a later layer overrides one with the same name in an earlier layer.
+// Partials that a later layer removed with a whiteout aren't loaded.
+func (r *Renderer) loadPartials(fs billy.Filesystem) (*template.Template, error) {
+	tmpl := template.New("").Funcs(r.funcMap())
+	filesystems := layers(fs)
+	for i, layer := range filesystems {
+		err := vfs.Walk(layer, "", func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if hiddenAbove(filesystems, i, path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.IsDir() || !isPartial(path) || vfs.IsWhiteout(filepath.Base(path)) {
+				return nil
+			}
+
+			f, err := layer.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			b, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+
+			// partials are named by their path, but any templates defined within
+			// them are available by their own name as well
+			_, err = tmpl.New(path).Parse(string(b))
+			return errors.Wrapf(err, "failed to parse partial '%s'", path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tmpl, nil
+}
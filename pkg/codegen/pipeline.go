@@ -0,0 +1,65 @@
+package codegen
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// renderJob is a file from the template filesystem that should be rendered
+type renderJob struct {
+	// source is the path of the file in the template filesystem
+	source string
+
+	// outputPath is the path the file should be written to, unless the
+	// template changes it
+	outputPath string
+
+	info os.FileInfo
+
+	// files and err are the result of rendering this job
+	files []*renderedFile
+	err   error
+}
+
+// renderJobs renders jobs concurrently, across at most GOMAXPROCS workers,
+// storing the result on each job. Jobs that haven't started when ctx is
+// canceled fail with its error.
+func (r *Renderer) renderJobs(ctx context.Context, fs billy.Filesystem, jobs []*renderJob, args map[string]interface{}) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	queue := make(chan *renderJob)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if err := ctx.Err(); err != nil {
+					job.err = err
+					continue
+				}
+
+				start := time.Now()
+				job.files, job.err = r.render(ctx, fs, job, args)
+				for _, rf := range job.files {
+					rf.renderTime = time.Since(start)
+				}
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+
+	wg.Wait()
+}
@@ -0,0 +1,373 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/pkg/errors"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/tools/imports"
+	"gopkg.in/yaml.v3"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const (
+	// OnErrorWarn reports a post-processor failure as a warning, and writes the
+	// file as it was before the post-processor ran
+	OnErrorWarn = "warn"
+
+	// OnErrorFail fails rendering when a post-processor fails
+	OnErrorFail = "error"
+)
+
+// PostProcessor processes the contents of a rendered file before it's written
+type PostProcessor interface {
+	// Process returns the processed contents of the file at path
+	Process(path string, data []byte) ([]byte, error)
+}
+
+// ContentMatcher is implemented by post-processors that should also be run on
+// files that their globs don't match, based on the contents of the file. This
+// is only done by default, or when a configuration doesn't set files, so that
+// template repositories can choose exactly which files are processed.
+type ContentMatcher interface {
+	// Matches returns true if the post-processor should be run on the file
+	Matches(path string, data []byte) bool
+}
+
+// serviceConfigurer is implemented by post-processors that are configured by
+// files in the service being rendered
+type serviceConfigurer interface {
+	forService(fs billy.Filesystem) (PostProcessor, error)
+}
+
+// PostProcessorFunc is a function that implements PostProcessor
+type PostProcessorFunc func(path string, data []byte) ([]byte, error)
+
+// Process calls f(path, data)
+func (f PostProcessorFunc) Process(path string, data []byte) ([]byte, error) {
+	return f(path, data)
+}
+
+var (
+	postProcessorsMu sync.RWMutex
+
+	// postProcessors are the post-processors that can be enabled by
+	// template repositories, by name
+	postProcessors = map[string]PostProcessor{
+		"goimports": PostProcessorFunc(func(path string, data []byte) ([]byte, error) {
+			return imports.Process(path, data, nil)
+		}),
+		"gofmt": PostProcessorFunc(func(path string, data []byte) ([]byte, error) {
+			return format.Source(data)
+		}),
+		"shfmt":      &shellFormatter{ec: &editorConfig{}},
+		"yaml":       PostProcessorFunc(formatYAML),
+		"json":       PostProcessorFunc(formatJSON),
+		"whitespace": PostProcessorFunc(formatWhitespace),
+		"gomodfmt":   PostProcessorFunc(formatGoMod),
+	}
+
+	// defaultPostProcessors are always enabled, unless a template repository
+	// configures a post-processor with the same name
+	defaultPostProcessors = []PostProcessorConfig{
+		{Name: "goimports", Files: []string{"*.go"}, OnError: OnErrorWarn},
+		{Name: "shfmt", Files: []string{"*.sh"}, OnError: OnErrorFail},
+	}
+)
+
+// RegisterPostProcessor makes a post-processor available to template repositories
+// under the given name, replacing any existing post-processor with that name
+func RegisterPostProcessor(name string, p PostProcessor) {
+	postProcessorsMu.Lock()
+	defer postProcessorsMu.Unlock()
+	postProcessors[name] = p
+}
+
+// enabledPostProcessor is a post-processor enabled for a set of files
+type enabledPostProcessor struct {
+	PostProcessorConfig
+
+	processor PostProcessor
+	files     gitignore.Matcher
+
+	// matchContents is whether files are also matched by their contents
+	matchContents bool
+}
+
+// enablePostProcessors resolves the post-processors that should be run on the service in
+// fs, from the configuration of template repositories, lowest first, and the defaults
+func enablePostProcessors(fs billy.Filesystem, configs []PostProcessorConfig) ([]*enabledPostProcessor, error) {
+	// later configurations replace earlier ones with the same name
+	byName := make(map[string]int)
+	merged := make([]PostProcessorConfig, 0)
+	matchContents := make([]bool, 0)
+	for i, c := range append(append([]PostProcessorConfig{}, defaultPostProcessors...), configs...) {
+		// defaults always match by contents, configurations only when they
+		// don't choose their files
+		contents := i < len(defaultPostProcessors) || c.Files == nil
+		if j, ok := byName[c.Name]; ok {
+			merged[j] = c
+			matchContents[j] = contents
+			continue
+		}
+		byName[c.Name] = len(merged)
+		merged = append(merged, c)
+		matchContents = append(matchContents, contents)
+	}
+
+	postProcessorsMu.RLock()
+	defer postProcessorsMu.RUnlock()
+
+	enabled := make([]*enabledPostProcessor, 0, len(merged))
+	for i, c := range merged {
+		p, ok := postProcessors[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("unknown post-processor '%s'", c.Name)
+		}
+
+		if sc, ok := p.(serviceConfigurer); ok {
+			var err error
+			if p, err = sc.forService(fs); err != nil {
+				return nil, errors.Wrapf(err, "failed to configure post-processor '%s'", c.Name)
+			}
+		}
+
+		if c.OnError == "" {
+			c.OnError = OnErrorWarn
+		}
+
+		if c.OnError != OnErrorWarn && c.OnError != OnErrorFail {
+			return nil, fmt.Errorf("invalid onError '%s' for post-processor '%s', expected '%s' or '%s'",
+				c.OnError, c.Name, OnErrorWarn, OnErrorFail)
+		}
+
+		ps := make([]gitignore.Pattern, len(c.Files))
+		for i, glob := range c.Files {
+			ps[i] = gitignore.ParsePattern(glob, nil)
+		}
+
+		enabled = append(enabled, &enabledPostProcessor{
+			PostProcessorConfig: c,
+			processor:           p,
+			files:               gitignore.NewMatcher(ps),
+			matchContents:       matchContents[i],
+		})
+	}
+
+	return enabled, nil
+}
+
+// matches returns true if this post-processor should be run on a rendered file
+func (pp *enabledPostProcessor) matches(rf *renderedFile) bool {
+	if isIgnored(pp.files, rf.path, false) {
+		return true
+	}
+
+	if !pp.matchContents {
+		return false
+	}
+
+	cm, ok := pp.processor.(ContentMatcher)
+	return ok && cm.Matches(rf.path, rf.data)
+}
+
+// runPostProcessors runs the enabled post-processors that match a rendered file
+func (r *Renderer) runPostProcessors(rf *renderedFile) error {
+	for _, pp := range r.postProcessors {
+		if !pp.matches(rf) {
+			continue
+		}
+
+		start := time.Now()
+		data, err := pp.processor.Process(rf.path, rf.data)
+		result := PostProcessorResult{Name: pp.Name, Duration: time.Since(start)}
+		if err != nil {
+			err = mapError(err, rf)
+			result.Error = err.Error()
+		} else {
+			result.Changed = !bytes.Equal(data, rf.data)
+		}
+		rf.postProcessors = append(rf.postProcessors, result)
+
+		// in strict mode, every failure is an error
+		if err != nil && (pp.OnError == OnErrorFail || r.strict) {
+			return withContext(errors.Wrapf(err, "%s failed on file '%s'", pp.Name, rf.path), rf)
+		} else if err != nil {
+			rf.warnings = append(rf.warnings, fmt.Sprintf("%s failed on file '%s': %v", pp.Name, rf.path, err))
+			continue
+		}
+
+		rf.data = data
+	}
+
+	return nil
+}
+
+// shellFormatter formats shell scripts like shfmt, using the options in the
+// EditorConfig file of the service that shfmt supports
+type shellFormatter struct {
+	ec *editorConfig
+}
+
+// shellVariants are the shell dialects, by the name of their interpreter
+var shellVariants = map[string]syntax.LangVariant{
+	"sh":   syntax.LangPOSIX,
+	"dash": syntax.LangPOSIX,
+	"ash":  syntax.LangPOSIX,
+	"bash": syntax.LangBash,
+	"mksh": syntax.LangMirBSDKorn,
+}
+
+func (s *shellFormatter) forService(fs billy.Filesystem) (PostProcessor, error) {
+	ec, err := readEditorConfig(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shellFormatter{ec}, nil
+}
+
+// Matches returns true for files with a shell shebang
+func (s *shellFormatter) Matches(path string, data []byte) bool {
+	_, ok := shebangVariant(data)
+	return ok
+}
+
+// Process formats a shell script
+func (s *shellFormatter) Process(path string, data []byte) ([]byte, error) {
+	props := s.ec.properties(path)
+
+	variant := syntax.LangBash
+	if v, ok := shebangVariant(data); ok {
+		variant = v
+	}
+	if v, ok := shellVariants[props["shell_variant"]]; ok {
+		variant = v
+	}
+
+	f, err := syntax.NewParser(syntax.Variant(variant), syntax.KeepComments(true)).Parse(bytes.NewReader(data), path)
+	if err != nil {
+		return nil, err
+	}
+
+	var indent uint
+	if props["indent_style"] == "space" {
+		indent = 2
+		if size, err := strconv.ParseUint(props["indent_size"], 10, 8); err == nil {
+			indent = uint(size)
+		}
+	}
+
+	var buf bytes.Buffer
+	err = syntax.NewPrinter(
+		syntax.Indent(indent),
+		syntax.BinaryNextLine(props["binary_next_line"] == "true"),
+		syntax.SwitchCaseIndent(props["switch_case_indent"] == "true"),
+		syntax.SpaceRedirects(props["space_redirects"] == "true"),
+		syntax.KeepPadding(props["keep_padding"] == "true"),
+		syntax.FunctionNextLine(props["function_next_line"] == "true"),
+	).Print(&buf, f)
+	return buf.Bytes(), err
+}
+
+// shebangVariant returns the shell dialect of a script from its shebang,
+// e.g. #!/usr/bin/env bash, if it has one
+func shebangVariant(data []byte) (syntax.LangVariant, bool) {
+	if !bytes.HasPrefix(data, []byte("#!")) {
+		return 0, false
+	}
+
+	line := string(data[2:])
+	if i := strings.IndexByte(line, '\n'); i != -1 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) != 0 && filepath.Base(fields[0]) == "env" {
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return 0, false
+	}
+
+	v, ok := shellVariants[filepath.Base(fields[0])]
+	return v, ok
+}
+
+// formatYAML normalizes the formatting of every document in a YAML file,
+// keeping comments
+func formatYAML(path string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var n yaml.Node
+		err := dec.Decode(&n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := enc.Encode(&n); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// formatJSON pretty-prints a JSON file
+func formatJSON(path string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteString("\n")
+
+	return buf.Bytes(), nil
+}
+
+// formatWhitespace removes trailing whitespace from every line, and ensures
+// that a file ends with exactly one newline
+func formatWhitespace(path string, data []byte) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	return []byte(strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n"), nil
+}
+
+// formatGoMod formats a go.mod file like `go mod edit -fmt`, removing duplicate
+// requirements and sorting its blocks. Requirements aren't added, removed or
+// upgraded, since that needs the module graph.
+func formatGoMod(path string, data []byte) ([]byte, error) {
+	f, err := modfile.Parse(path, data, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	f.SortBlocks()
+	f.Cleanup()
+
+	return f.Format()
+}
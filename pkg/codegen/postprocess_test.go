@@ -0,0 +1,65 @@
+package codegen
+
+import (
+	"testing"
+
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+func TestEnabledPostProcessorMatches(t *testing.T) {
+	script := &renderedFile{path: "bin/run", data: []byte("#!/usr/bin/env bash\necho hi\n")}
+	shell := &renderedFile{path: "run.sh", data: []byte("echo hi\n")}
+
+	tests := []struct {
+		name    string
+		configs []PostProcessorConfig
+
+		// script and shell are whether shfmt runs on each file
+		script bool
+		shell  bool
+	}{
+		{
+			name:   "default",
+			script: true,
+			shell:  true,
+		},
+		{
+			name:    "files aren't set",
+			configs: []PostProcessorConfig{{Name: "shfmt", OnError: OnErrorWarn}},
+			script:  true,
+		},
+		{
+			name:    "files are set",
+			configs: []PostProcessorConfig{{Name: "shfmt", Files: []string{"*.sh"}}},
+			shell:   true,
+		},
+		{
+			name:    "disabled",
+			configs: []PostProcessorConfig{{Name: "shfmt", Files: []string{}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enabled, err := enablePostProcessors(memfs.New(), tt.configs)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var shfmt *enabledPostProcessor
+			for _, pp := range enabled {
+				if pp.Name == "shfmt" {
+					shfmt = pp
+				}
+			}
+
+			if got := shfmt.matches(script); got != tt.script {
+				t.Errorf("matches(%s) = %v, want %v", script.path, got, tt.script)
+			}
+
+			if got := shfmt.matches(shell); got != tt.shell {
+				t.Errorf("matches(%s) = %v, want %v", shell.path, got, tt.shell)
+			}
+		})
+	}
+}
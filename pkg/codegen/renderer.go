@@ -12,8 +12,11 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 	"text/template"
+	"text/template/parse"
+	"time"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/pkg/errors"
@@ -21,11 +24,20 @@ import (
 	"github.com/tritonmedia/bootstraper/internal/vfs"
 
 	"github.com/go-git/go-billy/v5"
-	"golang.org/x/tools/imports"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 )
 
 var (
 	blockRX = regexp.MustCompile(`\w*(///|###)\s*([a-zA-Z]+)\(([a-zA-Z]+)\)`)
+
+	// itemRX matches the values set when a template is rendered once per item
+	itemRX = regexp.MustCompile(`\.(item|index)\b`)
+
+	// ignoredPaths are paths in a template repository that are never
+	// written to a service
+	ignoredPaths = []string{"manifest.yaml", ".git", ignoreFile}
 )
 
 type Renderer struct {
@@ -36,41 +48,164 @@ type Renderer struct {
 	fetcher *Fetcher
 	log     logrus.FieldLogger
 
+	// out is the filesystem of the service, rooted at dir
+	out billy.Filesystem
+
 	args map[string]Argument
+
+	// postProcessors are run, in order, on every rendered template
+	postProcessors []*enabledPostProcessor
+
+	// mergeRules are how rendered files are merged into existing files
+	mergeRules []*mergeRule
+
+	// strict turns every post-processor failure into an error
+	strict bool
+
+	// report is the report of the files written by GenerateFiles
+	report *Report
+
+	// hookConsent asks the user if a template repository may run hooks, and
+	// consentPath is where their answers are stored
+	hookConsent HookConsent
+	consentPath string
+
+	// partials is the set of templates shared by every template being
+	// rendered
+	partials *template.Template
+
+	// outputs maps the paths written by GenerateFiles to the template
+	// that wrote them
+	outputs map[string]string
+
+	// fs is the filesystem of templates being rendered
+	fs billy.Filesystem
+
+	// ignore matches templates that should not be rendered, and
+	// serviceIgnore matches paths that should not be written
+	ignore        *templateIgnores
+	serviceIgnore gitignore.Matcher
 }
 
 // NewRenderer creates a new template renderer that is the heart of bootstraper.
 func NewRenderer(log logrus.FieldLogger, branch, dir string, m *ServiceManifest) *Renderer {
-	fetcher := NewFetcher(log, m)
-	return &Renderer{
-		fetcher: fetcher,
-		branch:  branch,
-		dir:     dir,
-		m:       m,
-		log:     log,
+	return newRenderer(log, branch, dir, m, osfs.New(dir))
+}
+
+// newRenderer creates a template renderer that writes the service to out
+func newRenderer(log logrus.FieldLogger, branch, dir string, m *ServiceManifest, out billy.Filesystem) *Renderer {
+	fetcher := NewFetcher(log, dir, m)
+
+	// the defaults are always valid, these are replaced once the template
+	// repositories are known
+	postProcessors, _ := enablePostProcessors(out, nil) //nolint:errcheck
+	r := &Renderer{
+		fetcher:        fetcher,
+		branch:         branch,
+		dir:            dir,
+		m:              m,
+		log:            log,
+		out:            out,
+		postProcessors: postProcessors,
+		report:         newReport(),
+		outputs:        make(map[string]string),
 	}
+
+	// templates can be written with WriteTemplate before, or without,
+	// GenerateFiles loading partials
+	r.partials = template.New("").Funcs(r.funcMap())
+
+	return r
 }
 
-// Render starts the code generation process
-func (r *Renderer) Render(ctx context.Context, log *logrus.Entry) error {
+// SetStrict sets whether post-processor failures, e.g. generated Go files with
+// syntax errors, fail rendering instead of being reported as warnings
+func (r *Renderer) SetStrict(strict bool) {
+	r.strict = strict
+}
+
+// Render starts the code generation process, and returns a report of the files
+// that were produced
+func (r *Renderer) Render(ctx context.Context, log *logrus.Entry) (*Report, error) {
+	start := time.Now()
 	if len(r.m.Repositories) == 0 {
-		return fmt.Errorf("missing template repositories, must specify at least one")
+		return nil, fmt.Errorf("missing template repositories, must specify at least one")
 	}
 
-	fs, args, err := r.fetcher.CreateVFS()
+	fs, mf, err := r.fetcher.CreateVFS()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	fetchTime := time.Since(start)
+
+	if err := r.configure(mf); err != nil {
+		return nil, err
+	}
+
+	preHooks, err := r.enableHooks(HookPreRender, mf.Hooks.PreRender)
+	if err != nil {
+		return nil, err
+	}
+
+	postHooks, err := r.enableHooks(HookPostRender, mf.Hooks.PostRender)
+	if err != nil {
+		return nil, err
+	}
+
+	// consent is needed before anything is run, so that we don't stop
+	// half way through
+	if err := r.checkHookConsent(append(append([]repositoryHook{}, preHooks...), postHooks...)); err != nil {
+		return nil, err
+	}
+
+	r.report = newReport()
+	err = r.runHooks(ctx, preHooks)
+	if err == nil {
+		err = r.GenerateFiles(ctx, fs)
+	}
+
+	if err == nil {
+		err = r.runHooks(ctx, postHooks)
+	}
+
+	r.report.Timings.Fetch = fetchTime
+	r.report.Timings.Total = time.Since(start)
+	return r.report, err
+}
+
+// configure configures the renderer from the merged manifest of the template
+// repositories, and validates the service's arguments against it
+func (r *Renderer) configure(mf *TemplateRepositoryManifest) error {
+	r.args = mf.Arguments
+
+	var err error
+	r.postProcessors, err = enablePostProcessors(r.out, mf.PostProcessors)
+	if err != nil {
+		return errors.Wrap(err, "failed to enable post-processors")
+	}
+
+	r.mergeRules, err = compileMergeRules(mf.Merge)
+	if err != nil {
+		return errors.Wrap(err, "invalid merge rules")
 	}
-	r.args = args
 
-	for k, a := range args {
+	for k, a := range r.args {
 		v, isPresent := r.m.Arguments[k]
 
 		if !isPresent && a.Required {
 			return fmt.Errorf("missing required argument '%s'", k)
 		}
 
-		if v != "" && len(a.Values) > 0 {
+		if v == "" || len(a.Values) == 0 {
+			continue
+		}
+
+		values := []string{v}
+		if a.Type == "list" {
+			values = r.argList(k)
+		}
+
+		for _, v := range values {
 			found := false
 			for _, allowedV := range a.Values {
 				if v == allowedV {
@@ -85,44 +220,222 @@ func (r *Renderer) Render(ctx context.Context, log *logrus.Entry) error {
 		}
 	}
 
-	return r.GenerateFiles(ctx, fs)
+	return nil
 }
 
-// GenerateFiles generates files based on a TemplateList being provided.
+// GenerateFiles generates files from the templates, and other files, in a filesystem.
 func (r *Renderer) GenerateFiles(ctx context.Context, fs billy.Filesystem) error {
 	// Build the default set of parameters
 	args := map[string]interface{}{
 		"manifest": r.m,
 	}
 
-	return vfs.Walk(fs, "", func(path string, info os.FileInfo, err error) error {
+	partials, err := r.loadPartials(fs)
+	if err != nil {
+		return errors.Wrap(err, "failed to load partials")
+	}
+	r.partials = partials
+	r.fs = fs
+
+	r.ignore, err = loadTemplateIgnores(fs)
+	if err != nil {
+		return errors.Wrap(err, "failed to load template repository ignore files")
+	}
+
+	r.serviceIgnore, err = loadIgnore(r.out)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load %s", ignoreFile)
+	}
+
+	// outputs tracks the template that produced each output path, to catch
+	// templates that would overwrite each other
+	r.outputs = make(map[string]string)
+
+	// Collect everything that needs to be rendered first, since templates are
+	// rendered concurrently but written in the order they were found.
+	jobs := make([]*renderJob, 0)
+	err = vfs.Walk(fs, "", func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		// skip non .tpl files
-		if !strings.HasSuffix(path, ".tpl") {
+		// skip partials since they're included by other templates
+		if isPartial(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		// we don't care about directories
-		if info.IsDir() {
+		ignored := r.ignore.match(path, info.IsDir())
+		for _, p := range ignoredPaths {
+			if path == p {
+				ignored = true
+			}
+		}
+
+		if ignored {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		data, err := r.FetchTemplate(ctx, fs, path)
+		outputPath, ok, err := r.renderPath(strings.TrimSuffix(path, ".tpl"), args, true)
 		if err != nil {
-			return errors.Wrap(err, "failed to fetch template")
+			return errors.Wrapf(err, "failed to render path '%s'", path)
 		}
 
-		path = strings.TrimSuffix(path, ".tpl")
+		// paths that render to an empty segment are skipped, for directories
+		// this skips everything in them which allows for conditional directories
+		if !ok {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 
-		if err := r.WriteTemplate(ctx, path, data, args); err != nil {
-			return errors.Wrap(err, "failed to write template")
+		// we don't care about directories otherwise
+		if info.IsDir() {
+			return nil
 		}
 
+		jobs = append(jobs, &renderJob{source: path, outputPath: outputPath, info: info})
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	renderStart := time.Now()
+	r.renderJobs(ctx, fs, jobs, args)
+	r.report.Timings.Render = time.Since(renderStart)
+
+	writeStart := time.Now()
+	defer func() {
+		r.report.Timings.Write = time.Since(writeStart)
+	}()
+
+	for _, job := range jobs {
+		if job.err != nil {
+			return job.err
+		}
+
+		if err := r.claimOutputs(job.files); err != nil {
+			return err
+		}
+	}
+
+	for _, job := range jobs {
+		for _, rf := range job.files {
+			if err := r.writeRenderedFile(rf); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(r.report.Warnings) != 0 {
+		r.log.Warnf("Finished with %d warning(s):", len(r.report.Warnings))
+		for _, w := range r.report.Warnings {
+			r.log.Warnf(" -> %s", w)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// render renders a file from the template filesystem, returning the files
+// that it produced
+func (r *Renderer) render(ctx context.Context, fs billy.Filesystem, job *renderJob, args map[string]interface{}) ([]*renderedFile, error) {
+	data, err := r.FetchTemplate(ctx, fs, job.source)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch template")
+	}
+
+	mode := templateMode(job.info, job.outputPath)
+
+	// non .tpl files are copied as-is, unless the service provides a template
+	// to be rendered in place of them
+	if !strings.HasSuffix(job.source, ".tpl") {
+		overrideSource, overrideData, err := r.readOverrideTemplate(job.outputPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if overrideData != nil {
+			files, err := r.renderTemplate(overrideSource, job.outputPath, overrideData, mode, args)
+			return files, errors.Wrap(err, "failed to render override template")
+		}
+
+		// only templates can call forEach, so there's nothing to render
+		// .item or .index with
+		if strings.Contains(job.outputPath, "{{") {
+			return nil, fmt.Errorf("path '%s' uses .item or .index, but only templates (.tpl files) can call forEach", job.source)
+		}
+
+		rf := &renderedFile{
+			source:   job.source,
+			path:     job.outputPath,
+			data:     data,
+			mode:     mode,
+			write:    true,
+			verbatim: true,
+		}
+		return []*renderedFile{rf}, r.applyOverride(rf)
+	}
+
+	files, err := r.renderTemplate(job.source, job.outputPath, data, mode, args)
+	return files, errors.Wrap(err, "failed to render template")
+}
+
+// templateMode returns the mode that files rendered from a template should be
+// written with by default, which is the mode of the template itself. Shell
+// scripts are always executable by their owner.
+func templateMode(info os.FileInfo, path string) os.FileMode {
+	mode := os.FileMode(0644)
+	if info != nil {
+		mode = info.Mode().Perm()
+	}
+
+	if filepath.Ext(path) == ".sh" {
+		mode |= 0100
+	}
+
+	return mode
+}
+
+// renderPath renders every segment of a path that contains a template action
+// as a template, returning false if a segment rendered to an empty string. If
+// deferItems is set, segments that use .item or .index are left as they are,
+// since those are only known once a template calls forEach.
+func (r *Renderer) renderPath(path string, args map[string]interface{}, deferItems bool) (string, bool, error) {
+	if !strings.Contains(path, "{{") {
+		return path, true, nil
+	}
+
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if !strings.Contains(seg, "{{") || (deferItems && itemRX.MatchString(seg)) {
+			continue
+		}
+
+		tmpl, err := template.New(path).Funcs(r.funcMap()).Parse(seg)
+		if err != nil {
+			return "", false, err
+		}
+
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, args); err != nil {
+			return "", false, err
+		}
+
+		segments[i] = strings.TrimSpace(buf.String())
+		if segments[i] == "" {
+			return "", false, nil
+		}
+	}
+
+	return strings.Join(segments, "/"), true, nil
 }
 
 // FetchTemplate fetches a template from a git repository, or if Branch is set to ""
@@ -145,195 +458,591 @@ func (r *Renderer) FetchTemplate(ctx context.Context, fs billy.Filesystem, fileP
 	return ioutil.ReadAll(f)
 }
 
-// WriteTemplate handles the processing, and writing of a template to disk.
-func (r *Renderer) WriteTemplate(ctx context.Context, filePath string, contents []byte, args map[string]interface{}) error { //nolint:funlen,gocyclo,lll
+// WriteTemplate handles the processing, and writing of a template to disk. The source is the
+// path of the template, and filePath is the path it should be written to.
+func (r *Renderer) WriteTemplate(ctx context.Context, source, filePath string, contents []byte, args map[string]interface{}) error {
+	files, err := r.renderTemplate(source, filePath, contents, templateMode(nil, filePath), args)
+	if err != nil {
+		return err
+	}
+
+	if err := r.claimOutputs(files); err != nil {
+		return err
+	}
+
+	for _, rf := range files {
+		if err := r.writeRenderedFile(rf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderTemplate renders a template, and post-processes the files that it
+// produced, without writing them. Files are written with mode, unless the
+// template changes it. This is safe to call concurrently.
+func (r *Renderer) renderTemplate(source, filePath string, contents []byte, mode os.FileMode, args map[string]interface{}) ([]*renderedFile, error) {
+	rendered, err := r.execTemplate(source, filePath, contents, mode, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// overrides are found by the path a file is written to, which isn't known
+	// until its template is executed
+	files := make([]*renderedFile, 0, len(rendered))
+	for _, rf := range rendered {
+		overridden, err := r.renderOverrideTemplate(rf)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, overridden...)
+	}
+
+	for _, rf := range files {
+		if err := r.applyOverride(rf); err != nil {
+			return nil, err
+		}
+
+		if err := r.merge(rf); err != nil {
+			return nil, err
+		}
+
+		if err := r.runPostProcessors(rf); err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// readBlocks reads the blocks of an existing file into args
+func (r *Renderer) readBlocks(filePath string, args map[string]interface{}) { //nolint:funlen,gocyclo
 	// Search for any commands that are inscribed in the file.
 	// Currently we use StartBlock and EndBlock to allow for
 	// arbitrary data payloads to be saved across runs of bootstraper.
 	// Eventually we might want to support 3 way merge instead
-	f, err := os.Open(filePath)
-	if err == nil {
-		defer f.Close()
-
-		var curBlockName string
-		var i = 0
-
-		scanner := bufio.NewScanner(f)
-		for scanner.Scan() {
-			i++
-
-			line := scanner.Text()
-			matches := blockRX.FindStringSubmatch(line)
-			isCommand := false
-
-			// 1: Comment (###|///)
-			// 2: Command
-			// 3: Argument to the command
-			if len(matches) == 4 {
-				cmd := matches[2]
-				isCommand = true
-
-				switch cmd {
-				case "StartBlock":
-					blockName := matches[3]
-
-					if curBlockName != "" {
-						r.log.Fatalf("Invalid StartBlock when already inside of a block, at %s:%d", filePath, i)
-					}
-					curBlockName = blockName
-				case "EndBlock":
-					blockName := matches[3]
-
-					if blockName != curBlockName {
-						r.log.Fatalf(
-							"Invalid EndBlock, found EndBlock with name '%s' while inside of block with name '%s', at %s:%d",
-							blockName, curBlockName, filePath, i,
-						)
-					}
-
-					if curBlockName == "" {
-						r.log.Fatalf("Invalid EndBlock when not inside of a block, at %s:%d", filePath, i)
-					}
-
-					curBlockName = ""
-				default:
-					isCommand = false
+	f, err := r.out.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var curBlockName string
+	var i = 0
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		i++
+
+		line := scanner.Text()
+		matches := blockRX.FindStringSubmatch(line)
+		isCommand := false
+
+		// 1: Comment (###|///)
+		// 2: Command
+		// 3: Argument to the command
+		if len(matches) == 4 {
+			cmd := matches[2]
+			isCommand = true
+
+			switch cmd {
+			case "StartBlock":
+				blockName := matches[3]
+
+				if curBlockName != "" {
+					r.log.Fatalf("Invalid StartBlock when already inside of a block, at %s:%d", filePath, i)
 				}
-			}
+				curBlockName = blockName
+			case "EndBlock":
+				blockName := matches[3]
 
-			// we skip lines that had a recognized command in them, or that
-			// aren't in a block
-			if isCommand || curBlockName == "" {
-				continue
-			}
+				if blockName != curBlockName {
+					r.log.Fatalf(
+						"Invalid EndBlock, found EndBlock with name '%s' while inside of block with name '%s', at %s:%d",
+						blockName, curBlockName, filePath, i,
+					)
+				}
+
+				if curBlockName == "" {
+					r.log.Fatalf("Invalid EndBlock when not inside of a block, at %s:%d", filePath, i)
+				}
 
-			// add the line we processed to the current block we're in
-			// and account for having an existing curVal or not. If we
-			// don't then we assign curVal to start with the line we
-			// just found.
-			curVal, ok := args[curBlockName]
-			if ok {
-				args[curBlockName] = curVal.(string) + "\n" + line
-			} else {
-				args[curBlockName] = line
+				curBlockName = ""
+			default:
+				isCommand = false
 			}
 		}
+
+		// we skip lines that had a recognized command in them, or that
+		// aren't in a block
+		if isCommand || curBlockName == "" {
+			continue
+		}
+
+		// add the line we processed to the current block we're in
+		// and account for having an existing curVal or not. If we
+		// don't then we assign curVal to start with the line we
+		// just found.
+		curVal, ok := args[curBlockName]
+		if ok {
+			args[curBlockName] = curVal.(string) + "\n" + line
+		} else {
+			args[curBlockName] = line
+		}
 	}
+}
 
-	data, isStatic, shouldWriteFile, newFilePath, err := r.execTemplate(filePath, contents, args)
-	if err != nil {
-		return err
+// claimOutputs records the paths that files will be written to, returning an
+// error if another template already writes to one of them. This is done before
+// any of them are written, so that a conflict doesn't leave a partial service.
+func (r *Renderer) claimOutputs(files []*renderedFile) error {
+	for _, rf := range files {
+		if !rf.write {
+			continue
+		}
+
+		if source, ok := r.outputs[rf.path]; ok {
+			return fmt.Errorf("templates '%s' and '%s' both write to '%s'", source, rf.source, rf.path)
+		}
+		r.outputs[rf.path] = rf.source
 	}
 
-	absFilePath := filepath.Join(r.dir, newFilePath)
+	return nil
+}
+
+// writeRenderedFile writes a file produced by a template to disk, if it should
+// be written.
+func (r *Renderer) writeRenderedFile(rf *renderedFile) error {
+	absFilePath := filepath.Join(r.dir, rf.path)
 
-	action := "Updated"
+	start := time.Now()
+
+	action := FileUpdated
+	if _, err := r.out.Stat(rf.path); os.IsNotExist(err) {
+		action = FileCreated
+	}
 
-	// Why: We're fine shadowing err.
-	//nolint:govet
-	if _, err := os.Stat(absFilePath); os.IsNotExist(err) {
-		action = "Created"
+	shouldWriteFile := rf.write
+	if rf.static && action != FileCreated {
+		shouldWriteFile = false
 	}
 
-	if isStatic && action != "Created" {
+	if isIgnored(r.serviceIgnore, rf.path, false) {
 		shouldWriteFile = false
 	}
 
 	if !shouldWriteFile {
-		action = "Skipping"
+		action = FileSkipped
+	}
+
+	mode := rf.mode
+	if rf.modeOverride != 0 {
+		mode = rf.modeOverride
 	}
 
+	var err error
 	if shouldWriteFile {
-		ext := filepath.Ext(filePath)
-		switch ext {
-		case ".sh":
-			// post-process shell files by making them executable here
-			// TODO(jaredallard): run shfmt on them
-			err = r.writeFile(filePath, data, 0744)
-		case ".go":
-			err = r.postProcessGoFile(filePath, data)
-		default:
-			err = r.writeFile(filePath, data, 0644)
-		}
+		err = r.writeFile(rf.path, rf.data, mode)
+	}
+
+	// files that already exist keep their mode when they're written to, and
+	// not every filesystem supports changing it
+	if ch, ok := r.out.(billy.Change); ok && shouldWriteFile && err == nil {
+		err = ch.Chmod(rf.path, mode)
 	}
 
-	r.log.Infof(" -> %s file '%s'", action, filePath)
+	report := r.newFileReport(rf, action)
+	report.Write = time.Since(start)
+	r.report.Files = append(r.report.Files, report)
+	r.report.Warnings = append(r.report.Warnings, rf.warnings...)
+
+	log := r.log
+	if report.Layer != "" {
+		log = log.WithField("source", report.Layer)
+	}
+
+	for _, w := range rf.warnings {
+		log.Warn(w)
+	}
+	log.Infof(" -> %s file '%s'", actionVerbs[action], rf.path)
 	if err != nil {
 		return errors.Wrapf(err, "error creating file '%s'", absFilePath)
 	}
 
-	return err
+	return nil
 }
 
-// execTemplate executes a template and gets back metadata
-// returns the byte contents, if static, if we should write the file, the potentially new file name
-// and an error if it occurred
-func (r *Renderer) execTemplate(fileName string, body []byte, args map[string]interface{}) ([]byte, bool, bool, string, error) {
-	isStatic := false
-	writeFile := true
-	outputName := fileName
+// renderedFile is a file that was produced by executing a template
+type renderedFile struct {
+	// source is the path of the template that produced this file
+	source string
 
-	funcs := sprig.TxtFuncMap()
+	// template is the contents of the template that produced this file
+	template []byte
 
-	// argEq checks to see if an argument is equal to a given value
-	funcs["argEq"] = func(argName, value string) bool {
-		return r.m.Arguments[argName] == value
-	}
+	// path is the path, relative to the service, that this file should be
+	// written to
+	path string
+
+	// data is the contents of this file
+	data []byte
+
+	// args are the arguments the template was executed with
+	args map[string]interface{}
+
+	// static denotes that this file should only be written if it doesn't exist
+	static bool
+
+	// write denotes if this file should be written at all
+	write bool
+
+	// verbatim denotes that this file was copied from a template repository
+	// and should be written as-is
+	verbatim bool
+
+	// merge is the strategy, if set, this file is merged into the existing
+	// file with
+	merge string
+
+	// mode is the permissions this file should be written with
+	mode os.FileMode
+
+	// modeOverride, if set, is the mode this file should have regardless
+	// of how it was written
+	modeOverride os.FileMode
+
+	// warnings are problems that occurred while producing this file, they
+	// are reported when it's written
+	warnings []string
+
+	// postProcessors are the results of the post-processors run on this file
+	postProcessors []PostProcessorResult
+
+	// renderTime is how long it took to render the template that produced
+	// this file
+	renderTime time.Duration
+}
+
+// execTemplate executes the template at source and returns the files that it produced.
+// A template produces one file, unless it called forEach, in which case it is
+// executed again for every value of the given argument, with .item and .index
+// set to the current value and its position. The file name is rendered, as a path,
+// for every file, so that each item can be written to its own path.
+func (r *Renderer) execTemplate(source, fileName string, body []byte, mode os.FileMode, args map[string]interface{}) ([]*renderedFile, error) {
+	var rf *renderedFile
+	forEachArg := ""
+
+	funcs := r.funcMap()
 
 	// Static marks this file as static and doesn't write it if it already exists
 	funcs["static"] = func() bool {
-		isStatic = true
+		rf.static = true
 		return false
 	}
 
 	// setOutputName sets the output of this file
 	funcs["setOutputName"] = func(out string) bool {
-		outputName = out
+		rf.path = out
 		return false
 	}
 
 	// writeIf writes this file only if a given argument is equal to
 	// a specified value
 	funcs["writeIf"] = func(argName, value string) bool {
-		writeFile = false
+		rf.write = false
 		if r.m.Arguments[argName] == value {
-			writeFile = true
+			rf.write = true
 		}
 		return false
 	}
 
-	tmpl, err := template.New(fileName).Funcs(funcs).Parse(string(body))
+	// chmod sets the octal mode, e.g. "0755", this file is written with
+	funcs["chmod"] = func(mode string) (bool, error) {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid mode '%s'", mode)
+		}
+		rf.mode = os.FileMode(m).Perm()
+		return false, nil
+	}
+
+	// mergeStrategy merges this file into the existing file using a strategy,
+	// e.g. "yaml", instead of replacing it
+	funcs["mergeStrategy"] = func(strategy string) (bool, error) {
+		if _, ok := mergers[strategy]; !ok {
+			return false, fmt.Errorf("unknown merge strategy '%s'", strategy)
+		}
+		rf.merge = strategy
+		return false, nil
+	}
+
+	// forEach renders this template once per value of a list argument
+	funcs["forEach"] = func(argName string) bool {
+		forEachArg = argName
+		return false
+	}
+
+	tmpl, err := r.partials.Clone()
 	if err != nil {
-		return nil, false, false, "", err
+		return nil, err
+	}
+
+	// include renders a named template and returns it as a string, which,
+	// unlike the template action, allows it to be piped
+	funcs["include"] = func(name string, data interface{}) (string, error) {
+		var buf bytes.Buffer
+		execErr := tmpl.ExecuteTemplate(&buf, name, data)
+		return buf.String(), execErr
+	}
+
+	tmpl, err = tmpl.Funcs(funcs).New(source).Parse(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	// exec renders the file name and template with data, returning nil if the
+	// file name rendered to an empty segment
+	exec := func(data map[string]interface{}, deferItems bool) (*renderedFile, error) {
+		path, ok, pathErr := r.renderPath(fileName, data, deferItems)
+		if pathErr != nil {
+			return nil, errors.Wrapf(pathErr, "failed to render path '%s'", fileName)
+		} else if !ok {
+			return nil, nil
+		}
+
+		// blocks are specific to the file being rendered
+		fileArgs := make(map[string]interface{}, len(data))
+		for k, v := range data {
+			fileArgs[k] = v
+		}
+		r.readBlocks(path, fileArgs)
+
+		rf = &renderedFile{source: source, template: body, path: path, mode: mode, write: true, args: fileArgs}
+
+		var buf bytes.Buffer
+		if execErr := tmpl.Execute(&buf, fileArgs); execErr != nil {
+			return nil, execErr
+		}
+		rf.data = buf.Bytes()
+
+		return rf, nil
+	}
+
+	// the argument forEach is called with isn't known until the template is
+	// executed, so templates that call it are executed once with .item and
+	// .index set to zero values to find it. Errors are ignored since the
+	// template might expect an actual item.
+	if callsFunc(tmpl, "forEach") {
+		zeroArgs := make(map[string]interface{}, len(args)+2)
+		for k, v := range args {
+			zeroArgs[k] = v
+		}
+		zeroArgs["item"] = ""
+		zeroArgs["index"] = 0
+
+		exec(zeroArgs, true) //nolint:errcheck
+	}
+
+	if forEachArg == "" {
+		f, err := exec(args, true)
+		if err != nil {
+			return nil, err
+		}
+
+		if f == nil {
+			return []*renderedFile{}, nil
+		}
+
+		// only segments that use .item or .index are left unrendered
+		if strings.Contains(f.path, "{{") {
+			return nil, fmt.Errorf("path '%s' uses .item or .index, but its template doesn't call forEach", fileName)
+		}
+
+		return []*renderedFile{f}, nil
+	}
+
+	items := r.argList(forEachArg)
+	files := make([]*renderedFile, 0, len(items))
+	for i, item := range items {
+		itemArgs := make(map[string]interface{}, len(args)+2)
+		for k, v := range args {
+			itemArgs[k] = v
+		}
+		itemArgs["item"] = item
+		itemArgs["index"] = i
+
+		f, err := exec(itemArgs, false)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to render item '%s'", item)
+		}
+
+		if f != nil {
+			files = append(files, f)
+		}
 	}
 
-	var buf bytes.Buffer
-	// Why: We're fine shadowing err.
-	//nolint:govet
-	if err := tmpl.Execute(&buf, args); err != nil {
-		return []byte{}, false, false, "", errors.Wrap(err, "failed to render template")
+	return files, nil
+}
+
+// callsFunc returns true if a template, or any template associated with it,
+// calls the function name
+func callsFunc(tmpl *template.Template, name string) bool {
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && nodeCallsFunc(t.Tree.Root, name) {
+			return true
+		}
 	}
 
-	return buf.Bytes(), isStatic, writeFile, outputName, err
+	return false
 }
 
-func (r *Renderer) postProcessGoFile(fileName string, data []byte) error {
-	result, err := imports.Process(fileName, data, nil)
+// nodeCallsFunc returns true if a parse tree node calls the function name
+func nodeCallsFunc(node parse.Node, name string) bool { //nolint:gocyclo
+	switch n := node.(type) {
+	case *parse.IdentifierNode:
+		return n.Ident == name
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Nodes {
+			if nodeCallsFunc(c, name) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeCallsFunc(n.Pipe, name)
+	case *parse.TemplateNode:
+		return n.Pipe != nil && nodeCallsFunc(n.Pipe, name)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, c := range n.Cmds {
+			if nodeCallsFunc(c, name) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			if nodeCallsFunc(a, name) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return nodeCallsFunc(&n.BranchNode, name)
+	case *parse.RangeNode:
+		return nodeCallsFunc(&n.BranchNode, name)
+	case *parse.WithNode:
+		return nodeCallsFunc(&n.BranchNode, name)
+	case *parse.BranchNode:
+		return nodeCallsFunc(n.Pipe, name) || nodeCallsFunc(n.List, name) || nodeCallsFunc(n.ElseList, name)
+	}
+
+	return false
+}
+
+// argList returns the values of a list argument, which are separated
+// by commas
+func (r *Renderer) argList(argName string) []string {
+	v := r.m.Arguments[argName]
+	if strings.TrimSpace(v) == "" {
+		return []string{}
+	}
+
+	items := strings.Split(v, ",")
+	for i := range items {
+		items[i] = strings.TrimSpace(items[i])
+	}
+
+	return items
+}
+
+// funcMap returns the functions available to every template. Functions that
+// change how a file is written are no-ops here, execTemplate provides the real
+// implementations.
+func (r *Renderer) funcMap() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+
+	// argEq checks to see if an argument is equal to a given value
+	funcs["argEq"] = func(argName, value string) bool {
+		return r.m.Arguments[argName] == value
+	}
+
+	// argList returns the values of a list argument
+	funcs["argList"] = r.argList
+
+	noop := func(...interface{}) bool { return false }
+	funcs["static"] = noop
+	funcs["setOutputName"] = noop
+	funcs["writeIf"] = noop
+	funcs["chmod"] = noop
+	funcs["mergeStrategy"] = noop
+	funcs["forEach"] = noop
+	funcs["include"] = func(string, interface{}) (string, error) { return "", nil }
+
+	return funcs
+}
+
+// layers returns the layers of a filesystem, lowest first, or just the
+// filesystem itself if it isn't layered
+func layers(fs billy.Filesystem) []billy.Filesystem {
+	mfs, ok := fs.(*vfs.MergedFS)
+	if !ok {
+		return []billy.Filesystem{fs}
+	}
+
+	filesystems := make([]billy.Filesystem, 0, len(mfs.Layers()))
+	for _, l := range mfs.Layers() {
+		filesystems = append(filesystems, l.FS)
+	}
+
+	return filesystems
+}
+
+// hiddenAbove returns if a path in the i-th of a filesystem's layers, lowest first,
+// is hidden by a whiteout in a layer above it
+func hiddenAbove(filesystems []billy.Filesystem, i int, path string) bool {
+	for _, fs := range filesystems[i+1:] {
+		if vfs.HidesLower(fs, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// layerName returns the name of the layer that a template was read from,
+// files that aren't from a layer are from the service itself
+func (r *Renderer) layerName(path string) string {
+	mfs, ok := r.fs.(*vfs.MergedFS)
+	if !ok {
+		return ""
+	}
+
+	p, err := mfs.Explain(path)
 	if err != nil {
-		// set result to data to allow us to be DRY in writing, we only want a
-		// warning here
-		result = data
+		return "service"
+	}
+
+	return p.Layer.String()
+}
 
-		r.log.Warnf("goimports failed on file '%s': %v", fileName, err)
+// readFile reads the contents of a file in a filesystem
+func readFile(fs billy.Filesystem, path string) ([]byte, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	return r.writeFile(fileName, result, 0644)
+	return ioutil.ReadAll(f)
 }
 
 func (r *Renderer) writeFile(fileName string, data []byte, perm os.FileMode) error {
-	fileName = filepath.Join(r.dir, fileName)
-	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+	if err := r.out.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(fileName, data, perm)
+	return util.WriteFile(r.out, fileName, data, perm)
 }
@@ -0,0 +1,206 @@
+package codegen
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestRenderer creates a renderer of a service, with arguments, that is
+// written to memory
+func newTestRenderer(t *testing.T, m *ServiceManifest) (*Renderer, billy.Filesystem) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	out := memfs.New()
+	r := newRenderer(log, "master", "/service", m, out)
+	if err := r.configure(&TemplateRepositoryManifest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return r, out
+}
+
+// newTemplates creates a template filesystem of files, by path
+func newTemplates(t *testing.T, files map[string]string) billy.Filesystem {
+	fs := memfs.New()
+	for path, data := range files {
+		if err := util.WriteFile(fs, path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return fs
+}
+
+func TestWriteTemplateWithoutGenerateFiles(t *testing.T) {
+	r, out := newTestRenderer(t, &ServiceManifest{Name: "svc"})
+
+	err := r.WriteTemplate(context.Background(), "main.go.tpl", "main.go",
+		[]byte("package {{ .manifest.Name }}\n"), map[string]interface{}{"manifest": r.m})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := readFile(out, "main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := string(b), "package svc\n"; got != want {
+		t.Errorf("main.go = %q, want %q", got, want)
+	}
+}
+
+func TestGenerateFilesForEach(t *testing.T) {
+	r, out := newTestRenderer(t, &ServiceManifest{
+		Name:      "svc",
+		Arguments: map[string]string{"commands": "a,b"},
+	})
+
+	fs := newTemplates(t, map[string]string{
+		"cmd/{{ .item }}/main.go.tpl": "{{- if forEach \"commands\" }}{{ end -}}\n// {{ .item | upper }} {{ .index }}\npackage main\n",
+	})
+
+	if err := r.GenerateFiles(context.Background(), fs); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"cmd/a/main.go": "// A 0\npackage main\n",
+		"cmd/b/main.go": "// B 1\npackage main\n",
+	} {
+		b, err := readFile(out, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", path, b, want)
+		}
+	}
+}
+
+func TestGenerateFilesOverrideTemplate(t *testing.T) {
+	r, out := newTestRenderer(t, &ServiceManifest{
+		Name:      "svc",
+		Arguments: map[string]string{"commands": "a,b"},
+		Files: map[string]*FileOverride{
+			"cmd/a/main.go": {Template: "templates/main.go.tpl"},
+			"renamed.go":    {Template: "templates/renamed.go.tpl"},
+		},
+	})
+
+	overrides := map[string]string{
+		"templates/main.go.tpl":    "// override {{ .item }}\n",
+		"templates/renamed.go.tpl": "// override {{ .manifest.Name }}\n",
+	}
+	for path, data := range overrides {
+		if err := util.WriteFile(out, path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := newTemplates(t, map[string]string{
+		"cmd/{{ .item }}/main.go.tpl": "{{- if forEach \"commands\" }}{{ end -}}\n// {{ .item }}\n",
+		"name.go.tpl":                 "{{- if setOutputName \"renamed.go\" }}{{ end -}}\n// renamed\n",
+	})
+
+	if err := r.GenerateFiles(context.Background(), fs); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]string{
+		"cmd/a/main.go": "// override a\n",
+		"cmd/b/main.go": "// b\n",
+		"renamed.go":    "// override svc\n",
+	} {
+		b, err := readFile(out, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != want {
+			t.Errorf("%s = %q, want %q", path, b, want)
+		}
+	}
+}
+
+func TestGenerateFilesVerbatimItemPath(t *testing.T) {
+	r, out := newTestRenderer(t, &ServiceManifest{
+		Name:      "svc",
+		Arguments: map[string]string{"commands": "a,b"},
+	})
+
+	fs := newTemplates(t, map[string]string{
+		"cmd/{{ .item }}/main.go.tpl": "{{- if forEach \"commands\" }}{{ end -}}\n// {{ .item }}\n",
+		"cmd/{{ .item }}/README":      "readme\n",
+	})
+
+	err := r.GenerateFiles(context.Background(), fs)
+	if err == nil || !strings.Contains(err.Error(), "only templates") {
+		t.Fatalf("GenerateFiles() = %v, want an error about .item in a file that isn't a template", err)
+	}
+
+	if _, err := out.Stat("cmd/{{ .item }}/README"); err == nil {
+		t.Error("file was written to a path with an unrendered .item")
+	}
+}
+
+func TestGenerateFilesOutputConflict(t *testing.T) {
+	r, out := newTestRenderer(t, &ServiceManifest{Name: "svc"})
+
+	fs := newTemplates(t, map[string]string{
+		"a.go.tpl": "// a\n",
+		"b.go.tpl": "{{- if setOutputName \"c.go\" }}{{ end -}}\n// b\n",
+		"c.go.tpl": "// c\n",
+	})
+
+	err := r.GenerateFiles(context.Background(), fs)
+	if err == nil || !strings.Contains(err.Error(), "both write to 'c.go'") {
+		t.Fatalf("GenerateFiles() = %v, want a conflict on c.go", err)
+	}
+
+	// nothing is written when there's a conflict
+	if _, err := out.Stat("a.go"); err == nil {
+		t.Error("a.go was written before the conflict was found")
+	}
+}
+
+func TestGenerateFilesShellScriptMode(t *testing.T) {
+	r, out := newTestRenderer(t, &ServiceManifest{Name: "svc"})
+
+	fs := newTemplates(t, map[string]string{
+		"scripts/build.sh":     "#!/usr/bin/env bash\n",
+		"scripts/test.sh.tpl":  "#!/usr/bin/env bash\n",
+		"scripts/README.md":    "scripts\n",
+		"scripts/notes.md.tpl": "notes\n",
+	})
+
+	if err := r.GenerateFiles(context.Background(), fs); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, want := range map[string]os.FileMode{
+		"scripts/build.sh":  0744,
+		"scripts/test.sh":   0744,
+		"scripts/README.md": 0644,
+		"scripts/notes.md":  0644,
+	} {
+		info, err := out.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s mode = %v, want %v", path, got, want)
+		}
+	}
+}
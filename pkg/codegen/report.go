@@ -0,0 +1,137 @@
+package codegen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Report is the result of rendering a service. Durations are in nanoseconds
+// when encoded as JSON.
+type Report struct {
+	// Files are the files that were produced, in the order they were written
+	Files []*FileReport `json:"files"`
+
+	// Warnings are every warning reported while rendering
+	Warnings []string `json:"warnings"`
+
+	// Hooks are the hooks that were run, in the order they were run
+	Hooks []*HookReport `json:"hooks"`
+
+	Timings Timings `json:"timings"`
+}
+
+// Timings are how long each phase of rendering took
+type Timings struct {
+	// Fetch is how long it took to download the template repositories
+	Fetch time.Duration `json:"fetch"`
+
+	// Render is how long it took to render every template
+	Render time.Duration `json:"render"`
+
+	// Write is how long it took to write every file
+	Write time.Duration `json:"write"`
+
+	Total time.Duration `json:"total"`
+}
+
+// FileReport describes a file that was produced by a template
+type FileReport struct {
+	// Action is what happened to the file, see the File* constants
+	Action string `json:"action"`
+
+	// Path is the path, relative to the service, of the file
+	Path string `json:"path"`
+
+	// Source is the path of the template, or file, that produced this file
+	Source string `json:"source"`
+
+	// Layer is the template repository that the source came from, or
+	// "service" if it came from the service itself
+	Layer string `json:"layer"`
+
+	// Bytes is the size of the contents that were rendered
+	Bytes int `json:"bytes"`
+
+	// Hash is the hex encoded SHA-256 of the contents that were rendered
+	Hash string `json:"hash"`
+
+	// PostProcessors are the post-processors that were run on this file
+	PostProcessors []PostProcessorResult `json:"postProcessors"`
+
+	Warnings []string `json:"warnings"`
+
+	// Render is how long it took to render the template that produced this
+	// file, which is shared by every file it produced
+	Render time.Duration `json:"render"`
+
+	// Write is how long it took to write this file
+	Write time.Duration `json:"write"`
+}
+
+// PostProcessorResult is the result of running a post-processor on a file
+type PostProcessorResult struct {
+	Name string `json:"name"`
+
+	// Changed is true if the post-processor changed the file
+	Changed bool `json:"changed"`
+
+	// Error is the error the post-processor failed with, if it failed
+	Error string `json:"error,omitempty"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+const (
+	// FileCreated is a file that didn't exist, and was written
+	FileCreated = "created"
+
+	// FileUpdated is a file that already existed, and was written
+	FileUpdated = "updated"
+
+	// FileSkipped is a file that wasn't written
+	FileSkipped = "skipped"
+)
+
+// actionVerbs are how actions are logged
+var actionVerbs = map[string]string{
+	FileCreated: "Created",
+	FileUpdated: "Updated",
+	FileSkipped: "Skipping",
+}
+
+// newReport creates an empty report
+func newReport() *Report {
+	return &Report{
+		Files:    make([]*FileReport, 0),
+		Warnings: make([]string, 0),
+		Hooks:    make([]*HookReport, 0),
+	}
+}
+
+// newFileReport creates the report for a rendered file
+func (r *Renderer) newFileReport(rf *renderedFile, action string) *FileReport {
+	hash := sha256.Sum256(rf.data)
+
+	pps := rf.postProcessors
+	if pps == nil {
+		pps = make([]PostProcessorResult, 0)
+	}
+
+	warnings := rf.warnings
+	if warnings == nil {
+		warnings = make([]string, 0)
+	}
+
+	return &FileReport{
+		Action:         action,
+		Path:           rf.path,
+		Source:         rf.source,
+		Layer:          r.layerName(rf.source),
+		Bytes:          len(rf.data),
+		Hash:           hex.EncodeToString(hash[:]),
+		PostProcessors: pps,
+		Warnings:       warnings,
+		Render:         rf.renderTime,
+	}
+}
@@ -0,0 +1,151 @@
+package codegen
+
+import (
+	"fmt"
+	"go/scanner"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// actionRX matches a template action, e.g. {{ .manifest.Name }}
+var actionRX = regexp.MustCompile(`{{.*?}}`)
+
+// errorLine returns the line, of the file being processed, that an error
+// occurred on, if it's known
+func errorLine(err error) (int, bool) {
+	var (
+		shErr   syntax.ParseError
+		langErr syntax.LangError
+		goErrs  scanner.ErrorList
+		goErr   *scanner.Error
+	)
+
+	switch {
+	case errors.As(err, &shErr):
+		return int(shErr.Pos.Line()), true
+	case errors.As(err, &langErr):
+		return int(langErr.Pos.Line()), true
+	case errors.As(err, &goErrs) && len(goErrs) != 0:
+		return goErrs[0].Pos.Line, true
+	case errors.As(err, &goErr):
+		return goErr.Pos.Line, true
+	}
+
+	return 0, false
+}
+
+// templateLine maps a line of a rendered file back to the line of the template that
+// most likely produced it, or returns 0 if no line of the template could have. A
+// template line could have produced a rendered line if the text around its actions
+// matches, and of those, the closest to the rendered line is used.
+func templateLine(tpl, rendered []byte, line int) int {
+	renderedLines := strings.Split(string(rendered), "\n")
+	if line < 1 || line > len(renderedLines) {
+		return 0
+	}
+
+	want := strings.TrimSpace(renderedLines[line-1])
+	if want == "" {
+		return 0
+	}
+
+	best := 0
+	for i, tplLine := range strings.Split(string(tpl), "\n") {
+		tplLine = strings.TrimSpace(tplLine)
+
+		// lines that are only actions match anything
+		literals := actionRX.Split(tplLine, -1)
+		if strings.TrimSpace(strings.Join(literals, "")) == "" {
+			continue
+		}
+
+		for j := range literals {
+			literals[j] = regexp.QuoteMeta(literals[j])
+		}
+
+		rx, err := regexp.Compile("^" + strings.Join(literals, ".*") + "$")
+		if err != nil || !rx.MatchString(want) {
+			continue
+		}
+
+		if best == 0 || abs(i+1-line) < abs(best-line) {
+			best = i + 1
+		}
+	}
+
+	return best
+}
+
+// mapError annotates an error, from processing a rendered file, with the line of
+// the template that it most likely occurred on
+func mapError(err error, rf *renderedFile) error {
+	line, ok := errorLine(err)
+	if !ok {
+		return err
+	}
+
+	tplLine := templateLine(rf.template, rf.data, line)
+	if tplLine == 0 {
+		return err
+	}
+
+	return errors.Wrapf(err, "line %d of template '%s'", tplLine, rf.source)
+}
+
+// contextError is an error that occurred on a line of a rendered file, and the
+// lines around it
+type contextError struct {
+	err     error
+	context string
+}
+
+func (e *contextError) Error() string {
+	return e.err.Error() + "\n" + e.context
+}
+
+func (e *contextError) Unwrap() error {
+	return e.err
+}
+
+// withContext adds the lines of a rendered file around the line that an error,
+// from processing it, occurred on to the error
+func withContext(err error, rf *renderedFile) error {
+	line, ok := errorLine(err)
+	if !ok {
+		return err
+	}
+
+	return &contextError{err, lineContext(rf.data, line, 2)}
+}
+
+// lineContext returns a line of a file, and the n lines around it, numbered
+// with the line itself marked
+func lineContext(data []byte, line, n int) string {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+
+	var b strings.Builder
+	for i := line - n; i <= line+n; i++ {
+		if i < 1 || i > len(lines) {
+			continue
+		}
+
+		marker := " "
+		if i == line {
+			marker = ">"
+		}
+		fmt.Fprintf(&b, "%s %4d | %s\n", marker, i, lines[i-1])
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+
+	return i
+}
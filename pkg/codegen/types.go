@@ -1,19 +1,22 @@
 package codegen
 
-// TemplateList is a list of templates in a directory that should be
-// processed
-type TemplateList struct {
-	// Templates contains a list of templates to write to. The string here is the
-	// path that a template should be written to.
-	Templates map[string]*Template `yaml:"files"`
-}
-
-type Template struct {
-	// Source is where the template is in relation to `pkg/codegen/templates`
-	Source string `yaml:"templatePath"`
+// FileOverride changes how a single file is written to a service
+type FileOverride struct {
+	// Skip prevents this file from being written.
+	Skip bool `yaml:"skip,omitempty"`
 
-	// Static determines if this template should be written only once.
+	// Static determines if this file should be written only once.
 	Static bool `yaml:"static,omitempty"`
+
+	// Mode is the octal file mode, e.g. "0755", this file should be written with.
+	Mode string `yaml:"mode,omitempty"`
+
+	// OutputPath is the path this file should be written to instead.
+	OutputPath string `yaml:"outputPath,omitempty"`
+
+	// Template is the path of a template, relative to the service, that should be
+	// rendered in place of the one provided by the template repositories.
+	Template string `yaml:"template,omitempty"`
 }
 
 // ServiceManifest is a manifest used to describe a service and impact
@@ -28,6 +31,10 @@ type ServiceManifest struct {
 
 	// Arguments is a map of arbitrary arguments to pass to the generator
 	Arguments map[string]string `yaml:"arguments"`
+
+	// Files are overrides for how specific files are written, keyed by
+	// the path that they would be written to
+	Files map[string]*FileOverride `yaml:"files,omitempty"`
 }
 
 // TemplateRepository is a repository of template files.
@@ -39,6 +46,12 @@ type TemplateRepository struct {
 	// Version is a semantic version of the template repository that should be downloaded
 	// if not set then the latest version is used.
 	Version string `yaml:"version"`
+
+	// Priority determines which template repository a file is used from when
+	// more than one provides it, the highest priority wins. Repositories with the
+	// same priority are ordered so that a repository wins over its dependencies,
+	// and later repositories win over earlier ones.
+	Priority int `yaml:"priority,omitempty"`
 }
 
 // TemplateRepositoryManifest is a manifest of a template repository
@@ -54,14 +67,31 @@ type TemplateRepositoryManifest struct {
 
 	// Arguments are a declaration of arguments to the template generator
 	Arguments map[string]Argument
+
+	// PostProcessors are post-processors that should be run on files
+	// before they're written
+	PostProcessors []PostProcessorConfig `yaml:"postProcessors,omitempty"`
+
+	// Merge are rules for merging rendered files into the files that already
+	// exist in a service, instead of replacing them
+	Merge []MergeRule `yaml:"merge,omitempty"`
+
+	// Hooks are commands that are run in the service before and after it's
+	// rendered, which the user has to allow first
+	Hooks Hooks `yaml:"hooks,omitempty"`
+
+	// TemplatesDir is the directory, relative to the root of the repository, that
+	// contains the templates. Defaults to the root of the repository.
+	TemplatesDir string `yaml:"templatesDir,omitempty"`
 }
 
 type Argument struct {
 	// Required denotes this argument as required.
 	Required bool `yaml:"required"`
 
-	// Type declares the type of the argument. This is not implemented
-	// yet, so is likely to change in the future.
+	// Type declares the type of the argument. This is not enforced
+	// yet, so is likely to change in the future. Arguments of type "list"
+	// are a comma separated list of values.
 	Type string `yaml:"type"`
 
 	// Values is a list of possible values for this, if empty all input is
@@ -71,3 +101,83 @@ type Argument struct {
 	// Description is a description of this argument. Optional.
 	Description string `yaml:"description"`
 }
+
+// MergeRule configures how rendered files are merged into existing files. Keys
+// are referred to by their path, e.g. "linters.enable", where a "*" matches any key.
+type MergeRule struct {
+	// Files are globs, using gitignore syntax, of the files this rule applies to
+	Files []string `yaml:"files"`
+
+	// Strategy is how the files are merged, either "yaml", "json" or "gomod". If not set,
+	// files are only merged if their template asks for it.
+	Strategy string `yaml:"strategy,omitempty"`
+
+	// TemplateOwned are keys that are always set to their rendered value, and
+	// removed if they're no longer rendered
+	TemplateOwned []string `yaml:"templateOwned,omitempty"`
+
+	// UserOwned are keys that are never changed once they exist
+	UserOwned []string `yaml:"userOwned,omitempty"`
+
+	// Lists are how specific lists are merged, lists are replaced by default
+	Lists []ListRule `yaml:"lists,omitempty"`
+}
+
+// ListRule configures how a list is merged
+type ListRule struct {
+	// Path is the key of the list
+	Path string `yaml:"path"`
+
+	// Strategy is either "append", "replace" or "keyed"
+	Strategy string `yaml:"strategy"`
+
+	// Key is the key of the maps in the list that identifies them, when
+	// the strategy is "keyed"
+	Key string `yaml:"key,omitempty"`
+}
+
+// Hooks are commands that are run in a service
+type Hooks struct {
+	// PreRender are run, in order, before any file is written
+	PreRender []Hook `yaml:"preRender,omitempty"`
+
+	// PostRender are run, in order, after every file was written
+	PostRender []Hook `yaml:"postRender,omitempty"`
+}
+
+// Hook is a command that is run in a service. Commands are run without a shell,
+// and only receive a few environment variables, e.g. PATH and HOME.
+type Hook struct {
+	// Command is the command, and its arguments, e.g. ["go", "mod", "tidy"].
+	// The command must be installed locally.
+	Command []string `yaml:"command"`
+
+	// If are arguments, and the values they must have, for this hook to run
+	If map[string]string `yaml:"if,omitempty"`
+
+	// Timeout is how long this hook can run for, e.g. "30s", defaulting to
+	// five minutes
+	Timeout string `yaml:"timeout,omitempty"`
+
+	// Env are the names of additional environment variables this hook receives
+	Env []string `yaml:"env,omitempty"`
+
+	// repository is the template repository that declared this hook, it's
+	// set when manifests are merged
+	repository string
+}
+
+// PostProcessorConfig enables a post-processor for a set of files
+type PostProcessorConfig struct {
+	// Name is the name of the post-processor, e.g. goimports
+	Name string `yaml:"name"`
+
+	// Files are globs, using gitignore syntax, of the files this post-processor
+	// should be run on. If set, even to an empty list, files aren't matched by
+	// their contents, e.g. scripts with a shell shebang for shfmt.
+	Files []string `yaml:"files"`
+
+	// OnError is what happens when the post-processor fails, either "warn"
+	// (the default) or "error"
+	OnError string `yaml:"onError,omitempty"`
+}